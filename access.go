@@ -0,0 +1,52 @@
+package shelob
+
+import (
+	"net"
+)
+
+// accessList holds the allowed and denied client networks.
+type accessList struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// permits returns true if the IP may connect. Denied networks take precedence
+// over allowed networks, and an empty allow list allows every address which
+// is not denied.
+func (a *accessList) permits(ip net.IP) bool {
+	for _, n := range a.denied {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccessLists replaces the allowed and denied networks. New connections are
+// checked against the new lists while open connections are left alone.
+func (s *Server) SetAccessLists(allowed, denied []*net.IPNet) {
+	s.accessMu.Lock()
+	s.access = &accessList{allowed, denied}
+	s.accessMu.Unlock()
+}
+
+// permits checks the remote address against the access lists. Addresses
+// without an IP, such as unix sockets, are always permitted.
+func (s *Server) permits(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	s.accessMu.RLock()
+	access := s.access
+	s.accessMu.RUnlock()
+	return access.permits(ip)
+}
@@ -0,0 +1,73 @@
+package shelob
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8", "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, denied := nets[:1], nets[1:]
+
+	for _, tc := range []struct {
+		access   accessList
+		ip       string
+		expected bool
+	}{
+		{accessList{}, "192.168.0.1", true},
+		{accessList{allowed: allowed}, "10.2.0.1", true},
+		{accessList{allowed: allowed}, "192.168.0.1", false},
+		{accessList{denied: denied}, "10.1.0.1", false},
+		{accessList{denied: denied}, "10.2.0.1", true},
+		{accessList{allowed, denied}, "10.1.0.1", false},
+		{accessList{allowed, denied}, "10.2.0.1", true},
+	} {
+		if tc.access.permits(net.ParseIP(tc.ip)) != tc.expected {
+			t.Errorf("%+v: expected %s permitted=%t", tc.access, tc.ip, tc.expected)
+		}
+	}
+}
+
+func TestConnectionDenied(t *testing.T) {
+	events := make(chan Event, 4)
+	denied, err := ParseCIDRs("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, addr := startTestServer(t, &Config{
+		DeniedNetworks: denied,
+		EventHandler: func(evt Event) {
+			switch evt.(type) {
+			case *ConnectionDeniedEvent, *ConnectionOpenedEvent:
+				events <- evt
+			}
+		},
+	})
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case evt := <-events:
+		if _, ok := evt.(*ConnectionDeniedEvent); !ok {
+			t.Fatalf("expected ConnectionDeniedEvent, got %T", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ConnectionDeniedEvent")
+	}
+
+	// The lists can be swapped at runtime
+	srv.SetAccessLists(denied, nil)
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	if _, ok := (<-events).(*ConnectionOpenedEvent); !ok {
+		t.Fatal("expected ConnectionOpenedEvent")
+	}
+}
@@ -0,0 +1,177 @@
+package shelob
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables of systemd socket activation and of upgrades.
+const (
+	envListenPID      = "LISTEN_PID"
+	envListenFDs      = "LISTEN_FDS"
+	envListenFDNames  = "LISTEN_FDNAMES"
+	envUpgradeReadyFD = "SHELOB_UPGRADE_READY_FD"
+)
+
+// listenFDsStart is the first inherited file descriptor.
+const listenFDsStart = 3
+
+// inheritedListener is a listening socket passed in by systemd or by the
+// previous process of an upgrade.
+type inheritedListener struct {
+	net.Listener
+	name string
+}
+
+// inherited holds the sockets passed to the process. The environment is read
+// once and cleared so child processes do not inherit it.
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []inheritedListener
+	readyFD   int
+	err       error
+}
+
+func loadInherited() {
+	inherited.once.Do(func() {
+		inherited.listeners, inherited.err = listenersFromEnv(os.Getenv, listenFDsStart)
+		if fd, err := strconv.Atoi(os.Getenv(envUpgradeReadyFD)); err == nil {
+			inherited.readyFD = fd
+		}
+		for _, key := range []string{envListenPID, envListenFDs, envListenFDNames, envUpgradeReadyFD} {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// listenersFromEnv creates listeners from the file descriptors described by the
+// LISTEN_FDS and LISTEN_FDNAMES variables. A LISTEN_PID of another process is
+// ignored. Upgrades do not set LISTEN_PID as the pid is not known in advance.
+func listenersFromEnv(getenv func(string) string, start int) ([]inheritedListener, error) {
+	if pid := getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count := getenv(envListenFDs)
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", envListenFDs, count)
+	}
+
+	var names []string
+	if v := getenv(envListenFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	listeners := make([]inheritedListener, 0, n)
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+
+		// FileListener duplicates the descriptor, so the original is closed.
+		f := os.NewFile(uintptr(start+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited listener %d: %s", start+i, err)
+		}
+		listeners = append(listeners, inheritedListener{l, name})
+	}
+	return listeners, nil
+}
+
+// inherit hands the inherited sockets to the listeners which were not given a
+// net.Listener. Sockets are matched to listeners by name first, then by the
+// address they are bound to. A listener left without a socket while others
+// remain unmatched is an error, rather than serving on an unexpected address.
+func (s *Server) inherit() error {
+	loadInherited()
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.err != nil {
+		return inherited.err
+	}
+	if len(inherited.listeners) == 0 {
+		return nil
+	}
+
+	take := func(l *listener, match func(inheritedListener) bool) {
+		for i, il := range inherited.listeners {
+			if match(il) {
+				l.Listener = il.Listener
+				inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+	for _, l := range s.listeners {
+		if l.Listener == nil {
+			take(l, func(il inheritedListener) bool { return il.name == l.name })
+		}
+	}
+	for _, l := range s.listeners {
+		if l.Listener == nil {
+			take(l, func(il inheritedListener) bool { return l.bindsTo(il.Addr()) })
+		}
+	}
+
+	for _, l := range s.listeners {
+		if l.Listener == nil && len(inherited.listeners) > 0 {
+			var names []string
+			for _, il := range inherited.listeners {
+				names = append(names, fmt.Sprintf("%q on %s", il.name, il.Addr()))
+			}
+			return fmt.Errorf("listener %q: no inherited socket matches its name or address %q, inherited %s",
+				l.name, l.addr, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// bindsTo reports whether the listener would bind to the address. An
+// unspecified host matches any unspecified address, of either IP version.
+func (l *listener) bindsTo(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	bind := l.addr
+	if bind == "" {
+		bind = ":22"
+	}
+	want, err := net.ResolveTCPAddr("tcp", bind)
+	if err != nil || want.Port == 0 || want.Port != tcpAddr.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return want.IP.Equal(tcpAddr.IP)
+}
+
+// notifyReady tells the previous process of an upgrade that the listeners are open.
+func notifyReady() {
+	inherited.mu.Lock()
+	fd := inherited.readyFD
+	inherited.readyFD = 0
+	inherited.mu.Unlock()
+
+	if fd > 0 {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package shelob
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// idleTimeoutMessage is written to the stderr of sessions closed by an idle timeout.
+const idleTimeoutMessage = "Idle timeout, disconnecting.\r\n"
+
+// activity records the time channel data was last sent or received.
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// waitIdle blocks until there has been no activity for the timeout and returns
+// true. It returns false if the context is done first.
+func (a *activity) waitIdle(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+		if idle >= timeout {
+			return true
+		}
+		timer.Reset(timeout - idle)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// activityNewChannel records the data of the channel once accepted.
+type activityNewChannel struct {
+	ssh.NewChannel
+	activity *activity
+}
+
+func (c *activityNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &activityChannel{ch, c.activity}, reqs, nil
+}
+
+// activityChannel records reads and writes of channel data.
+type activityChannel struct {
+	ssh.Channel
+	activity *activity
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+func (c *activityChannel) Write(p []byte) (int, error) {
+	c.activity.touch()
+	return c.Channel.Write(p)
+}
+
+func (c *activityChannel) Stderr() io.ReadWriter {
+	return &activityReadWriter{c.Channel.Stderr(), c.activity}
+}
+
+type activityReadWriter struct {
+	io.ReadWriter
+	activity *activity
+}
+
+func (rw *activityReadWriter) Read(p []byte) (int, error) {
+	n, err := rw.ReadWriter.Read(p)
+	if n > 0 {
+		rw.activity.touch()
+	}
+	return n, err
+}
+
+func (rw *activityReadWriter) Write(p []byte) (int, error) {
+	rw.activity.touch()
+	return rw.ReadWriter.Write(p)
+}
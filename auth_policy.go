@@ -0,0 +1,198 @@
+package shelob
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthMethodCertificate is public key authentication with a user certificate,
+// for policies which require a certificate rather than any public key.
+const AuthMethodCertificate = "certificate"
+
+const permAuthMethods = "auth-methods"
+
+var errAuthMethodNotAllowed = errors.New("ssh: authentication method not allowed by the policy")
+
+// AuthPolicy lists the chains of authentication methods which authenticate a
+// user. Every method of a chain must succeed, in order, and any one chain is
+// enough. Methods are the AuthMethod constants. A certificate satisfies a
+// publickey step, unless another chain at the same step requires a certificate.
+type AuthPolicy [][]string
+
+// ParseAuthPolicy parses the sshd AuthenticationMethods format, space separated
+// chains of comma separated methods: "publickey,keyboard-interactive password".
+func ParseAuthPolicy(s string) (AuthPolicy, error) {
+	var policy AuthPolicy
+	for _, field := range strings.Fields(s) {
+		chain := strings.Split(field, ",")
+		for _, method := range chain {
+			switch method {
+			case AuthMethodPublicKey, AuthMethodCertificate, AuthMethodPassword, AuthMethodKeyboardInteractive:
+			default:
+				return nil, fmt.Errorf("invalid authentication method %q", method)
+			}
+		}
+		policy = append(policy, chain)
+	}
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("empty authentication policy")
+	}
+	return policy, nil
+}
+
+func (p AuthPolicy) String() string {
+	chains := make([]string, len(p))
+	for i, chain := range p {
+		chains[i] = strings.Join(chain, ",")
+	}
+	return strings.Join(chains, " ")
+}
+
+// allows reports whether a chain continues with the method after the completed ones.
+func (p AuthPolicy) allows(done []string, method string) bool {
+	for _, chain := range p {
+		if len(chain) > len(done) && hasPrefix(chain, done) && chain[len(done)] == method {
+			return true
+		}
+	}
+	return false
+}
+
+// completes reports whether the completed methods are one of the chains.
+func (p AuthPolicy) completes(done []string) bool {
+	for _, chain := range p {
+		if len(chain) == len(done) && hasPrefix(chain, done) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(chain, prefix []string) bool {
+	for i := range prefix {
+		if chain[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// authChains enforces the AuthPolicy of users with the authentication
+// callbacks of a ServerConfig. Each step which does not complete a chain
+// returns a PartialSuccessError offering the methods which may follow it.
+type authChains struct {
+	policy func(user string) AuthPolicy
+	base   ssh.ServerAuthCallbacks
+}
+
+// authPolicyWrapper replaces the authentication callbacks of the config with
+// the first step of the chains of the policy.
+func authPolicyWrapper(sshConfig *ssh.ServerConfig, policy func(user string) AuthPolicy) {
+	a := &authChains{
+		policy: policy,
+		base: ssh.ServerAuthCallbacks{
+			PasswordCallback:            sshConfig.PasswordCallback,
+			PublicKeyCallback:           sshConfig.PublicKeyCallback,
+			KeyboardInteractiveCallback: sshConfig.KeyboardInteractiveCallback,
+		},
+	}
+	first := a.callbacks(nil, nil, nil)
+	sshConfig.PasswordCallback = first.PasswordCallback
+	sshConfig.PublicKeyCallback = first.PublicKeyCallback
+	sshConfig.KeyboardInteractiveCallback = first.KeyboardInteractiveCallback
+}
+
+// callbacks returns the callbacks of the methods which may follow the
+// completed ones. On the first step, done is nil and the policy of the user
+// is looked up.
+func (a *authChains) callbacks(policy AuthPolicy, done []string, perms *ssh.Permissions) ssh.ServerAuthCallbacks {
+	policyFor := func(conn ssh.ConnMetadata) AuthPolicy {
+		if done == nil {
+			return a.policy(conn.User())
+		}
+		return policy
+	}
+	offered := func(methods ...string) bool {
+		for _, method := range methods {
+			if done == nil || policy.allows(done, method) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var next ssh.ServerAuthCallbacks
+	if cb := a.base.PasswordCallback; cb != nil && offered(AuthMethodPassword) {
+		next.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return a.step(policyFor(conn), done, perms, AuthMethodPassword, func() (*ssh.Permissions, error) {
+				return cb(conn, password)
+			})
+		}
+	}
+	if cb := a.base.PublicKeyCallback; cb != nil && offered(AuthMethodPublicKey, AuthMethodCertificate) {
+		next.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			policy := policyFor(conn)
+			method := AuthMethodPublicKey
+			if _, ok := key.(*ssh.Certificate); ok && policy.allows(done, AuthMethodCertificate) {
+				method = AuthMethodCertificate
+			}
+			return a.step(policy, done, perms, method, func() (*ssh.Permissions, error) {
+				return cb(conn, key)
+			})
+		}
+	}
+	if cb := a.base.KeyboardInteractiveCallback; cb != nil && offered(AuthMethodKeyboardInteractive) {
+		next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return a.step(policyFor(conn), done, perms, AuthMethodKeyboardInteractive, func() (*ssh.Permissions, error) {
+				return cb(conn, client)
+			})
+		}
+	}
+	return next
+}
+
+// step authenticates with the method if the policy allows it after the
+// completed methods. The permissions of the steps are merged, and the chain
+// is recorded once it is complete. Users without a policy are authenticated
+// by any single method.
+func (a *authChains) step(policy AuthPolicy, done []string, perms *ssh.Permissions, method string, authenticate func() (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	if policy != nil && !policy.allows(done, method) {
+		return nil, errAuthMethodNotAllowed
+	}
+	p, err := authenticate()
+	if err != nil {
+		return nil, err
+	}
+
+	chain := append(done[:len(done):len(done)], method)
+	merged := mergePermissions(perms, p)
+	if policy == nil || policy.completes(chain) {
+		merged.Extensions[permAuthMethods] = strings.Join(chain, ",")
+		return merged, nil
+	}
+	return nil, &ssh.PartialSuccessError{Next: a.callbacks(policy, chain, merged)}
+}
+
+// mergePermissions returns a copy of the permissions of the previous steps
+// with the permissions of the last step added.
+func mergePermissions(perms, last *ssh.Permissions) *ssh.Permissions {
+	merged := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for _, p := range []*ssh.Permissions{perms, last} {
+		if p == nil {
+			continue
+		}
+		for k, v := range p.CriticalOptions {
+			merged.CriticalOptions[k] = v
+		}
+		for k, v := range p.Extensions {
+			merged.Extensions[k] = v
+		}
+	}
+	return merged
+}
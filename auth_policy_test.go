@@ -0,0 +1,208 @@
+package shelob
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestParseAuthPolicy(t *testing.T) {
+	policy, err := ParseAuthPolicy("certificate  password,keyboard-interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.String() != "certificate password,keyboard-interactive" {
+		t.Errorf("unexpected policy %s", policy)
+	}
+	if !policy.allows(nil, AuthMethodPassword) || !policy.allows([]string{AuthMethodPassword}, AuthMethodKeyboardInteractive) {
+		t.Error("expected the password chain to be allowed")
+	}
+	if policy.allows(nil, AuthMethodKeyboardInteractive) || policy.allows(nil, AuthMethodPublicKey) {
+		t.Error("expected methods outside the chains to be refused")
+	}
+	if policy.completes([]string{AuthMethodPassword}) || !policy.completes([]string{AuthMethodCertificate}) {
+		t.Error("unexpected completed chains")
+	}
+
+	for _, invalid := range []string{"", "  ", "publickey,otp", "password,,publickey"} {
+		if _, err := ParseAuthPolicy(invalid); err == nil {
+			t.Errorf("expected %q to fail", invalid)
+		}
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	userKey := newTestSigner(t)
+	policies := map[string]string{
+		"alice": "publickey,keyboard-interactive",
+		"bob":   "password,keyboard-interactive publickey",
+	}
+
+	type result struct {
+		methods    []string
+		method     string
+		key        bool
+		registered string
+	}
+	results := make(chan result, 1)
+	var failuresMu sync.Mutex
+	var failures []*AuthFailedEvent
+	var srv *Server
+	conf := &Config{
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*AuthFailedEvent); ok {
+				failuresMu.Lock()
+				failures = append(failures, e)
+				failuresMu.Unlock()
+			}
+		},
+		ServerConfig: &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), userKey.PublicKey().Marshal()) {
+					return nil, errors.New("unauthorized")
+				}
+				return nil, nil
+			},
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if string(password) != "secret" {
+					return nil, errors.New("invalid password")
+				}
+				return nil, nil
+			},
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				var registered string
+				id, _ := ConnectionID(ctx)
+				for _, c := range srv.Connections() {
+					if c.ID == id {
+						registered = c.AuthMethod
+					}
+				}
+				results <- result{s.AuthMethods(), s.AuthMethod(), s.PublicKey() != nil, registered}
+				return 0
+			}, false, false),
+		},
+	}
+	options := []OptionFunc{
+		WithKeyboardInteractiveAuth("", []Question{{Prompt: "Code: "}}, func(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error) {
+			if answers[0] != "1234" {
+				return nil, errors.New("invalid code")
+			}
+			return nil, nil
+		}),
+		WithAuthPolicy(func(user string) AuthPolicy {
+			if methods, ok := policies[user]; ok {
+				policy, _ := ParseAuthPolicy(methods)
+				return policy
+			}
+			return nil
+		}),
+	}
+	for _, option := range options {
+		if err := option(conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv, addr := startTestServer(t, conf)
+	defer srv.Stop()
+	takeFailures := func() []*AuthFailedEvent {
+		failuresMu.Lock()
+		defer failuresMu.Unlock()
+		f := failures
+		failures = nil
+		return f
+	}
+
+	code := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"1234"}, nil
+	})
+	login := func(user string, auth ...ssh.AuthMethod) (result, error) {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err != nil {
+			return result{}, err
+		}
+		defer client.Close()
+		sess, err := client.NewSession()
+		if err != nil {
+			return result{}, err
+		}
+		sess.Run("")
+		return <-results, nil
+	}
+
+	// A single factor is not enough for a chain
+	if _, err := login("alice", ssh.PublicKeys(userKey)); err == nil {
+		t.Fatal("expected the public key alone to be refused")
+	}
+	if _, err := login("alice", code); err == nil {
+		t.Fatal("expected keyboard-interactive alone to be refused")
+	}
+	takeFailures()
+	r, err := login("alice", ssh.PublicKeys(userKey), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.methods, ",") != "publickey,keyboard-interactive" || !r.key {
+		t.Errorf("unexpected result %+v", r)
+	}
+
+	// Partial successes are not failed attempts, and the registry has the chain
+	for _, f := range takeFailures() {
+		t.Errorf("unexpected failure %s: %v", f.Method, f.Error)
+	}
+	if r.registered != "publickey,keyboard-interactive" || r.method != r.registered {
+		t.Errorf("expected the chain in the registry and the session, got %q and %q", r.registered, r.method)
+	}
+
+	// Either chain of the policy authenticates
+	if _, err := login("bob", ssh.Password("secret")); err == nil {
+		t.Fatal("expected the password alone to be refused")
+	}
+	r, err = login("bob", ssh.Password("secret"), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.methods, ",") != "password,keyboard-interactive" || r.key {
+		t.Errorf("unexpected result %+v", r)
+	}
+	r, err = login("bob", ssh.PublicKeys(userKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.methods, ",") != "publickey" {
+		t.Errorf("unexpected result %+v", r)
+	}
+
+	// Users without a policy use any single method
+	r, err = login("carol", ssh.Password("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.methods, ",") != "password" {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestAuthPolicyNoClientAuth(t *testing.T) {
+	_, err := New(context.Background(), &Config{
+		ServerConfig: &ssh.ServerConfig{NoClientAuth: true},
+		AuthPolicy: func(user string) AuthPolicy {
+			return AuthPolicy{{AuthMethodPublicKey}}
+		},
+	})
+	if err == nil {
+		t.Fatal("expected NoClientAuth to be refused with an AuthPolicy")
+	}
+}
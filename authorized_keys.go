@@ -0,0 +1,315 @@
+package shelob
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const permKeyOptions = "authorized-key-options"
+
+// errUnauthorizedKey is returned when no authorized_keys file permits the key.
+var errUnauthorizedKey = errors.New("ssh: public key not authorized")
+
+// KeyOptions are the OpenSSH options of an authorized_keys entry. The from
+// and expiry-time options are checked during authentication, the others are
+// enforced for the connection the key authenticated. The critical options and
+// missing permit-* extensions of user certificates are enforced as KeyOptions.
+type KeyOptions struct {
+
+	// Command replaces the command of every session. The command sent by the
+	// client is available in the SSH_ORIGINAL_COMMAND environment variable.
+	Command string `json:",omitempty"`
+
+	// From are the address patterns the key may be used from. Patterns are IP
+	// addresses with * and ? wildcards, or CIDR networks, and are negated with
+	// a leading !. Host name patterns are not resolved and never match.
+	From []string `json:",omitempty"`
+
+	// Environment is added to the environment of every session, in the form "key=value".
+	Environment []string `json:",omitempty"`
+
+	// ExpiryTime is the time after which the key is no longer accepted.
+	ExpiryTime time.Time `json:",omitempty"`
+
+	NoPty             bool `json:",omitempty"`
+	NoPortForwarding  bool `json:",omitempty"`
+	NoAgentForwarding bool `json:",omitempty"`
+	NoX11Forwarding   bool `json:",omitempty"`
+}
+
+// AuthorizedKey is an entry of an authorized_keys file.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	Options KeyOptions
+}
+
+// ParseAuthorizedKeys parses the entries of an authorized_keys file. Unknown
+// options are an error, so a key is never accepted without its restrictions.
+func ParseAuthorizedKeys(data []byte) ([]AuthorizedKey, error) {
+	var keys []AuthorizedKey
+	for line := 1; len(data) > 0; line++ {
+		var next []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data, next = data[:i], data[i+1:]
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '#' {
+			key, comment, options, _, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			opts, err := parseKeyOptions(options)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			keys = append(keys, AuthorizedKey{key, comment, opts})
+		}
+		data = next
+	}
+	return keys, nil
+}
+
+func parseKeyOptions(options []string) (KeyOptions, error) {
+	var opts KeyOptions
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], unquoteKeyOption(option[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "command":
+			opts.Command = value
+		case "from":
+			opts.From = strings.Split(value, ",")
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return opts, fmt.Errorf("invalid environment option %q", value)
+			}
+			opts.Environment = append(opts.Environment, value)
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.ExpiryTime = t
+		case "no-pty":
+			opts.NoPty = true
+		case "no-port-forwarding":
+			opts.NoPortForwarding = true
+		case "no-agent-forwarding":
+			opts.NoAgentForwarding = true
+		case "no-x11-forwarding":
+			opts.NoX11Forwarding = true
+		case "restrict":
+			opts.NoPty = true
+			opts.NoPortForwarding = true
+			opts.NoAgentForwarding = true
+			opts.NoX11Forwarding = true
+		default:
+			return opts, fmt.Errorf("unsupported key option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// unquoteKeyOption removes the quotes of an option value and unescapes quotes within.
+func unquoteKeyOption(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+	return value
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] format of the expiry-time
+// option, in local time unless followed by Z.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
+
+// permits reports whether the key may be used from the address at the time.
+func (o *KeyOptions) permits(addr net.Addr, now time.Time) bool {
+	if !o.ExpiryTime.IsZero() && !now.Before(o.ExpiryTime) {
+		return false
+	}
+	if len(o.From) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	return matchAddressPatterns(ip, o.From)
+}
+
+// matchAddressPatterns reports whether the IP matches one of the patterns and
+// none of the negated ones.
+func matchAddressPatterns(ip net.IP, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			ok = network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// keyOptions returns the options of the authorized_keys entry or certificate
+// the connection authenticated with, or nil.
+func keyOptions(perms *ssh.Permissions) *KeyOptions {
+	if perms == nil || perms.Extensions == nil {
+		return nil
+	}
+	data, ok := perms.Extensions[permKeyOptions]
+	if !ok {
+		return nil
+	}
+	var opts KeyOptions
+	if err := json.Unmarshal([]byte(data), &opts); err != nil {
+		return nil
+	}
+	return &opts
+}
+
+// Channel and request types of port forwarding, refused by no-port-forwarding.
+var (
+	forwardingChannels = map[string]bool{
+		"direct-tcpip":                   true,
+		"direct-streamlocal@openssh.com": true,
+	}
+	forwardingRequests = map[string]bool{
+		"tcpip-forward":                          true,
+		"cancel-tcpip-forward":                   true,
+		"streamlocal-forward@openssh.com":        true,
+		"cancel-streamlocal-forward@openssh.com": true,
+	}
+)
+
+// authorizedKeys authenticates public keys with authorized_keys files. The
+// files are parsed again when they change on disk.
+type authorizedKeys struct {
+	files       []string
+	handleEvent func(Event)
+
+	mu    sync.Mutex
+	cache map[string]*authorizedKeysFile
+}
+
+type authorizedKeysFile struct {
+	modTime time.Time
+	size    int64
+	keys    []AuthorizedKey
+}
+
+func newAuthorizedKeys(files []string, handleEvent func(Event)) *authorizedKeys {
+	return &authorizedKeys{
+		files:       files,
+		handleEvent: handleEvent,
+		cache:       make(map[string]*authorizedKeysFile),
+	}
+}
+
+// publicKeyCallback accepts the key if an entry of the user's files permits it.
+func (a *authorizedKeys) publicKeyCallback(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	now := time.Now()
+	wanted := key.Marshal()
+	for _, file := range a.files {
+		file, ok := expandUserPath(file, meta.User())
+		if !ok {
+			continue
+		}
+		for _, ak := range a.load(file) {
+			if !bytes.Equal(ak.Key.Marshal(), wanted) || !ak.Options.permits(meta.RemoteAddr(), now) {
+				continue
+			}
+			opts, err := json.Marshal(ak.Options)
+			if err != nil {
+				return nil, err
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{permKeyOptions: string(opts)},
+			}, nil
+		}
+	}
+	return nil, errUnauthorizedKey
+}
+
+// expandUserPath replaces %u in the path with the user and %% with %. Users
+// which could escape the directory are refused.
+func expandUserPath(file, user string) (string, bool) {
+	if !strings.Contains(file, "%") {
+		return file, true
+	}
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\\x00") {
+		return "", false
+	}
+	return strings.NewReplacer("%%", "%", "%u", user).Replace(file), true
+}
+
+// load returns the keys of the file, parsing it again if it changed. A file
+// which does not exist has no keys. A file which fails to parse has no keys
+// and an AuthorizedKeysFailedEvent is emitted once per change.
+func (a *authorizedKeys) load(file string) []AuthorizedKey {
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		if cached, ok := a.cache[file]; ok && cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+			return cached.keys
+		}
+	}
+
+	var keys []AuthorizedKey
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(file); err == nil {
+			keys, err = ParseAuthorizedKeys(data)
+		}
+	}
+	if err != nil {
+		if a.handleEvent != nil {
+			a.handleEvent(&AuthorizedKeysFailedEvent{File: file, Error: err})
+		}
+		keys = nil
+	}
+	if fi != nil {
+		a.cache[file] = &authorizedKeysFile{fi.ModTime(), fi.Size(), keys}
+	}
+	return keys
+}
@@ -0,0 +1,280 @@
+package shelob
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	signer := newTestSigner(t)
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	keys, err := ParseAuthorizedKeys([]byte(`# comment
+
+` + key + ` alice@laptop
+command="echo \"hi\"",from="10.0.0.0/8,!10.0.0.1",no-pty,no-port-forwarding,environment="FOO=bar",expiry-time="20300102Z" ` + key + `
+restrict ` + key + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(keys))
+	}
+	if keys[0].Comment != "alice@laptop" || keys[0].Options.Command != "" {
+		t.Errorf("unexpected key %+v", keys[0])
+	}
+
+	opts := keys[1].Options
+	if opts.Command != `echo "hi"` || !opts.NoPty || !opts.NoPortForwarding || opts.NoAgentForwarding {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if len(opts.From) != 2 || opts.From[1] != "!10.0.0.1" || len(opts.Environment) != 1 || opts.Environment[0] != "FOO=bar" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if !opts.ExpiryTime.Equal(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiry time %s", opts.ExpiryTime)
+	}
+	if opts := keys[2].Options; !opts.NoPty || !opts.NoPortForwarding || !opts.NoAgentForwarding || !opts.NoX11Forwarding {
+		t.Errorf("expected restrict to set all the restrictions, got %+v", opts)
+	}
+
+	for _, line := range []string{
+		"unknown-option " + key,
+		`expiry-time="2030" ` + key,
+		`environment="FOO" ` + key,
+		"ssh-ed25519 invalid",
+	} {
+		if _, err := ParseAuthorizedKeys([]byte(line)); err == nil {
+			t.Errorf("expected %q to fail", line)
+		}
+	}
+}
+
+func TestKeyOptionsPermits(t *testing.T) {
+	now := time.Now()
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	tests := []struct {
+		opts     KeyOptions
+		addr     net.Addr
+		expected bool
+	}{
+		{KeyOptions{}, addr("10.0.0.1"), true},
+		{KeyOptions{From: []string{"10.0.0.0/8"}}, addr("10.1.2.3"), true},
+		{KeyOptions{From: []string{"10.0.0.0/8"}}, addr("192.168.0.1"), false},
+		{KeyOptions{From: []string{"10.0.0.0/8", "!10.0.0.1"}}, addr("10.0.0.1"), false},
+		{KeyOptions{From: []string{"192.168.1.*"}}, addr("192.168.1.20"), true},
+		{KeyOptions{From: []string{"192.168.1.?"}}, addr("192.168.1.20"), false},
+		{KeyOptions{From: []string{"*.example.com"}}, addr("10.0.0.1"), false},
+		{KeyOptions{ExpiryTime: now.Add(time.Minute)}, addr("10.0.0.1"), true},
+		{KeyOptions{ExpiryTime: now}, addr("10.0.0.1"), false},
+	}
+	for _, tt := range tests {
+		if permits := tt.opts.permits(tt.addr, now); permits != tt.expected {
+			t.Errorf("%+v from %s: expected %v", tt.opts, tt.addr, tt.expected)
+		}
+	}
+}
+
+func TestExpandUserPath(t *testing.T) {
+	tests := []struct {
+		file, user, expected string
+		ok                   bool
+	}{
+		{"/etc/ssh/authorized_keys", "alice", "/etc/ssh/authorized_keys", true},
+		{"/etc/ssh/keys/%u", "alice", "/etc/ssh/keys/alice", true},
+		{"/etc/ssh/keys/%u%%", "alice", "/etc/ssh/keys/alice%", true},
+		{"/etc/ssh/keys/%u", "../root", "", false},
+		{"/etc/ssh/keys/%u", "..", "", false},
+		{"/etc/ssh/keys/%u", "", "", false},
+	}
+	for _, tt := range tests {
+		if file, ok := expandUserPath(tt.file, tt.user); file != tt.expected || ok != tt.ok {
+			t.Errorf("%s for %q: expected %q %v, got %q %v", tt.file, tt.user, tt.expected, tt.ok, file, ok)
+		}
+	}
+}
+
+func TestAuthorizedKeysFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice, bob, carol := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	authorized := func(opts string, signer ssh.Signer) string {
+		return opts + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	}
+	writeKeys := func(file, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("alice", authorized(`command="report --verbose",environment="TEAM=ops",no-pty,no-port-forwarding `, alice))
+	writeKeys("shared", authorized(`from="10.0.0.0/8" `, carol))
+
+	type result struct {
+		cmd       []string
+		env       []string
+		opts      *KeyOptions
+		pty       bool
+		publicKey bool
+	}
+	results := make(chan result, 1)
+	failures := make(chan *AuthorizedKeysFailedEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		ServerConfig:        &ssh.ServerConfig{},
+		AuthorizedKeysFiles: []string{filepath.Join(dir, "%u"), filepath.Join(dir, "shared")},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				_, _, pty := s.Pty()
+				results <- result{s.Command(), s.Environ(), s.KeyOptions(), pty, s.PublicKey() != nil}
+				return 0
+			}, true, false),
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*AuthorizedKeysFailedEvent); ok {
+				failures <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	dial := func(user string, signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	// The options of the key are enforced
+	client, err := dial("alice", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, _, err := client.OpenChannel("direct-tcpip", nil); err == nil {
+		t.Error("expected port forwarding to be refused")
+	} else if e, ok := err.(*ssh.OpenChannelError); !ok || e.Reason != ssh.Prohibited {
+		t.Errorf("unexpected error %v", err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err == nil {
+		t.Error("expected the PTY to be refused")
+	}
+	if err := sess.Run("ls -l"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-results
+	if strings.Join(r.cmd, " ") != "report --verbose" || r.pty || r.opts == nil || !r.opts.NoPty || !r.publicKey {
+		t.Errorf("unexpected session %+v", r)
+	}
+	env := strings.Join(r.env, ",")
+	if !strings.Contains(env, "SSH_ORIGINAL_COMMAND=ls -l") || !strings.Contains(env, "TEAM=ops") {
+		t.Errorf("unexpected environment %q", env)
+	}
+
+	// Keys are only accepted for their user, and from the permitted addresses
+	if _, err := dial("bob", alice); err == nil {
+		t.Error("expected the key of alice to be refused for bob")
+	}
+	if _, err := dial("carol", carol); err == nil {
+		t.Error("expected the key of carol to be refused from 127.0.0.1")
+	}
+
+	// Changed files are read again
+	if _, err := dial("bob", bob); err == nil {
+		t.Error("expected the key of bob to be refused")
+	}
+	writeKeys("bob", authorized("", bob))
+	client, err = dial("bob", bob)
+	if err != nil {
+		t.Fatalf("expected the key of bob to be accepted, got %v", err)
+	}
+	client.Close()
+
+	// Invalid files accept no keys
+	writeKeys("bob", "invalid "+authorized("", bob))
+	if _, err := dial("bob", bob); err == nil {
+		t.Error("expected the invalid file to be refused")
+	}
+	select {
+	case e := <-failures:
+		if e.File != filepath.Join(dir, "bob") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected an AuthorizedKeysFailedEvent")
+	}
+}
+
+func TestAuthorizedKeysFilesListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	alice, carol := newTestSigner(t), newTestSigner(t)
+	data := string(ssh.MarshalAuthorizedKey(alice.PublicKey())) + `from="10.0.0.0/8" ` + string(ssh.MarshalAuthorizedKey(carol.PublicKey()))
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptAll := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, nil
+	}
+	srv, _ := startTestServer(t, &Config{
+		ServerConfig:        &ssh.ServerConfig{},
+		AuthorizedKeysFiles: []string{filepath.Join(dir, "keys")},
+		Listeners: []ListenerConfig{{
+			Name:         "admin",
+			Listener:     admin,
+			ServerConfig: &ssh.ServerConfig{PublicKeyCallback: acceptAll},
+			PrivateKey:   newTestSigner(t),
+		}},
+	})
+	defer srv.Stop()
+
+	// A listener with its own ServerConfig enforces the files too
+	dial := func(signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", admin.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	if err := dial(alice); err != nil {
+		t.Fatalf("expected the authorized key to be accepted, got %v", err)
+	}
+	if err := dial(carol); err == nil {
+		t.Fatal("expected the from option to be enforced")
+	}
+	if err := dial(newTestSigner(t)); err == nil {
+		t.Fatal("expected an unknown key to be refused")
+	}
+}
@@ -0,0 +1,437 @@
+package shelob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BanConfig bans client addresses which repeatedly fail authentication.
+// Connections from banned addresses are closed before the handshake.
+type BanConfig struct {
+
+	// MaxFailures bans an address once a single user fails authentication
+	// from it this many times within Window.
+	MaxFailures int
+
+	// MaxIPFailures bans an address once it fails authentication this many
+	// times within Window across all users. Zero disables the limit.
+	MaxIPFailures int
+
+	// Window is the sliding window failures are counted in. Defaults to 10 minutes.
+	Window time.Duration
+
+	// BanDuration is the duration of the first ban of an address. Each repeat
+	// ban doubles the duration up to MaxBanDuration. Defaults to 10 minutes.
+	BanDuration time.Duration
+
+	// MaxBanDuration caps the escalating ban duration. Defaults to 24 hours.
+	// Repeat offences are forgotten once an address has not been banned for
+	// this long.
+	MaxBanDuration time.Duration
+
+	// File persists the bans across restarts if set.
+	File string
+}
+
+// Ban is a banned client address.
+type Ban struct {
+	IP string `json:"ip"`
+
+	// Until is the time the ban expires. Bans with a zero Until are permanent.
+	Until time.Time `json:"until"`
+
+	// Offences is the number of times the address has been banned.
+	Offences int `json:"offences"`
+}
+
+// expired returns true if the ban has expired by now.
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// offence remembers a banned address for escalating repeat bans.
+type offence struct {
+	count   int
+	forgets time.Time
+}
+
+// banList tracks authentication failures and the banned addresses.
+type banList struct {
+	config      BanConfig
+	handleEvent func(Event)
+
+	mu        sync.Mutex
+	bans      map[string]*Ban
+	offences  map[string]offence
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newBanList(config BanConfig, handleEvent func(Event)) (*banList, error) {
+	if config.Window == 0 {
+		config.Window = 10 * time.Minute
+	}
+	if config.BanDuration == 0 {
+		config.BanDuration = 10 * time.Minute
+	}
+	if config.MaxBanDuration == 0 {
+		config.MaxBanDuration = 24 * time.Hour
+	}
+
+	b := &banList{
+		config:      config,
+		handleEvent: handleEvent,
+		bans:        make(map[string]*Ban),
+		offences:    make(map[string]offence),
+		failures:    make(map[string][]time.Time),
+		lastSweep:   time.Now(),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// enabled returns true if addresses are banned for failing authentication.
+func (b *banList) enabled() bool {
+	return b.config.MaxFailures > 0 || b.config.MaxIPFailures > 0
+}
+
+// banned returns the ban of the IP. Expired bans are removed.
+func (b *banList) banned(ip net.IP, now time.Time) (Ban, bool) {
+	key := ip.String()
+
+	b.mu.Lock()
+	ban, ok := b.bans[key]
+	if !ok {
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+	if !ban.expired(now) {
+		b.mu.Unlock()
+		return *ban, true
+	}
+	b.unban(key, now)
+	err := b.save()
+	b.mu.Unlock()
+
+	b.handleEvent(&ClientUnbannedEvent{IP: key})
+	b.saved(err)
+	return Ban{}, false
+}
+
+// failed records a failed authentication attempt and bans the IP if one of
+// the failure limits is reached.
+func (b *banList) failed(ip net.IP, user string, now time.Time) (Ban, bool) {
+	key := ip.String()
+
+	var events []Event
+	b.mu.Lock()
+	if now.Sub(b.lastSweep) >= b.config.Window {
+		for _, expired := range b.sweep(now) {
+			events = append(events, &ClientUnbannedEvent{IP: expired})
+		}
+	}
+
+	var ban Ban
+	userFailures := b.fail(key+"\x00"+user, now)
+	ipFailures := b.fail(key, now)
+	banned := b.config.MaxFailures > 0 && userFailures >= b.config.MaxFailures ||
+		b.config.MaxIPFailures > 0 && ipFailures >= b.config.MaxIPFailures
+	if banned {
+
+		// Clear the failures of the address, including those of other users.
+		for k := range b.failures {
+			if k == key || strings.HasPrefix(k, key+"\x00") {
+				delete(b.failures, k)
+			}
+		}
+
+		offences := b.offences[key].count + 1
+		duration := b.config.BanDuration
+		for i := 1; i < offences && duration < b.config.MaxBanDuration; i++ {
+			duration *= 2
+		}
+		if duration > b.config.MaxBanDuration {
+			duration = b.config.MaxBanDuration
+		}
+		ban = b.ban(key, now.Add(duration), offences)
+		events = append(events, &ClientBannedEvent{IP: key, Until: ban.Until, Offences: ban.Offences, User: user})
+	}
+
+	var err error
+	if len(events) > 0 {
+		err = b.save()
+	}
+	b.mu.Unlock()
+
+	for _, evt := range events {
+		b.handleEvent(evt)
+	}
+	b.saved(err)
+	return ban, banned
+}
+
+// fail adds a failure to the sliding window of the key and returns the
+// number of failures within the window.
+func (b *banList) fail(key string, now time.Time) int {
+	failures := prune(b.failures[key], now.Add(-b.config.Window))
+	failures = append(failures, now)
+	b.failures[key] = failures
+	return len(failures)
+}
+
+// prune drops the times before the cutoff.
+func prune(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// add bans the IP for the duration, or permanently if the duration is zero.
+func (b *banList) add(ip net.IP, duration time.Duration, now time.Time) (Ban, error) {
+	key := ip.String()
+
+	var until time.Time
+	if duration > 0 {
+		until = now.Add(duration)
+	}
+
+	b.mu.Lock()
+	ban := b.ban(key, until, b.offences[key].count+1)
+	err := b.save()
+	b.mu.Unlock()
+
+	b.handleEvent(&ClientBannedEvent{IP: key, Until: ban.Until, Offences: ban.Offences})
+	return ban, err
+}
+
+// remove lifts the ban of the IP. The offences are forgotten as well.
+func (b *banList) remove(ip net.IP) (bool, error) {
+	key := ip.String()
+
+	b.mu.Lock()
+	if _, ok := b.bans[key]; !ok {
+		b.mu.Unlock()
+		return false, nil
+	}
+	delete(b.bans, key)
+	delete(b.offences, key)
+	err := b.save()
+	b.mu.Unlock()
+
+	b.handleEvent(&ClientUnbannedEvent{IP: key})
+	return true, err
+}
+
+// list returns the active bans sorted by IP.
+func (b *banList) list(now time.Time) []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if !ban.expired(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// ban records the ban and the offence. Guarded by mu.
+func (b *banList) ban(key string, until time.Time, offences int) Ban {
+	ban := &Ban{IP: key, Until: until, Offences: offences}
+	b.bans[key] = ban
+	b.offences[key] = offence{offences, b.forgets(ban)}
+	return *ban
+}
+
+// unban removes an expired ban but remembers the offence. Guarded by mu.
+func (b *banList) unban(key string, now time.Time) {
+	delete(b.bans, key)
+	if o, ok := b.offences[key]; ok {
+		o.forgets = now.Add(b.config.MaxBanDuration)
+		b.offences[key] = o
+	}
+}
+
+// forgets returns the time the offence of the ban is forgotten.
+func (b *banList) forgets(ban *Ban) time.Time {
+	if ban.Until.IsZero() {
+		return time.Time{}
+	}
+	return ban.Until.Add(b.config.MaxBanDuration)
+}
+
+// sweep releases stale failures, expired bans and forgotten offences. The
+// addresses of the expired bans are returned. Guarded by mu.
+func (b *banList) sweep(now time.Time) []string {
+	cutoff := now.Add(-b.config.Window)
+	for key, failures := range b.failures {
+		if failures = prune(failures, cutoff); len(failures) == 0 {
+			delete(b.failures, key)
+		} else {
+			b.failures[key] = failures
+		}
+	}
+
+	var expired []string
+	for key, ban := range b.bans {
+		if ban.expired(now) {
+			b.unban(key, now)
+			expired = append(expired, key)
+		}
+	}
+	for key, o := range b.offences {
+		if _, banned := b.bans[key]; !banned && !o.forgets.IsZero() && now.After(o.forgets) {
+			delete(b.offences, key)
+		}
+	}
+	b.lastSweep = now
+	return expired
+}
+
+// load reads the persisted bans. A missing file is not an error.
+func (b *banList) load() error {
+	if b.config.File == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.config.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("ban file %s: %s", b.config.File, err)
+	}
+	now := time.Now()
+	for _, ban := range bans {
+		if net.ParseIP(ban.IP) == nil {
+			return fmt.Errorf("ban file %s: invalid IP %q", b.config.File, ban.IP)
+		}
+		if !ban.expired(now) {
+			b.ban(ban.IP, ban.Until, ban.Offences)
+		}
+	}
+	return nil
+}
+
+// save writes the bans to the file, replacing it atomically. Guarded by mu.
+func (b *banList) save() error {
+	if b.config.File == "" {
+		return nil
+	}
+
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.config.File), filepath.Base(b.config.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.config.File)
+}
+
+// saved emits an event if persisting the bans failed.
+func (b *banList) saved(err error) {
+	if err != nil {
+		b.handleEvent(&BanFileFailedEvent{File: b.config.File, Error: err})
+	}
+}
+
+// keyRefusedError is a public key refused by the PublicKeyCallback, rather than
+// a failed signature. Clients offer every key they have, so a user with many
+// keys would be banned before the right one is tried if they were counted.
+type keyRefusedError struct {
+	error
+}
+
+func (e *keyRefusedError) Unwrap() error {
+	return e.error
+}
+
+// authLogCallback wraps the AuthLogCallback of the ssh config to record failed
+// authentication attempts. Public keys which are refused, or not allowed by an
+// AuthPolicy, are not counted, while the other methods are. An invalid
+// signature is never logged, as the ssh package closes the connection on it.
+// The connection is closed once the client is banned.
+func (b *banList) authLogCallback(conn net.Conn, cb func(ssh.ConnMetadata, string, error)) func(ssh.ConnMetadata, string, error) {
+	return func(meta ssh.ConnMetadata, method string, err error) {
+		if cb != nil {
+			cb(meta, method, err)
+		}
+
+		// Clients usually try the none method first to list the methods.
+		if err == nil || method == "none" {
+			return
+		}
+		if _, ok := err.(*ssh.PartialSuccessError); ok {
+			return
+		}
+		var refused *keyRefusedError
+		if method == AuthMethodPublicKey && (errors.As(err, &refused) || errors.Is(err, errAuthMethodNotAllowed)) {
+			return
+		}
+		ip := addrIP(meta.RemoteAddr())
+		if ip == nil {
+			return
+		}
+		if _, banned := b.failed(ip, meta.User(), time.Now()); banned {
+			conn.Close()
+		}
+	}
+}
+
+// Bans returns the active bans.
+func (s *Server) Bans() []Ban {
+	return s.bans.list(time.Now())
+}
+
+// Ban bans the IP address for the duration, or permanently if the duration is
+// zero. Connections which are already open are not closed.
+func (s *Server) Ban(ip net.IP, duration time.Duration) error {
+	_, err := s.bans.add(ip, duration, time.Now())
+	return err
+}
+
+// Unban lifts the ban of the IP address and forgets its previous bans.
+func (s *Server) Unban(ip net.IP) error {
+	ok, err := s.bans.remove(ip)
+	if !ok {
+		return fmt.Errorf("%s is not banned", ip)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package shelob
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestBanEscalation(t *testing.T) {
+	b, err := newBanList(BanConfig{
+		MaxFailures:    2,
+		Window:         time.Minute,
+		BanDuration:    time.Minute,
+		MaxBanDuration: 3 * time.Minute,
+	}, func(Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Now()
+
+	// Failures outside of the window are not counted
+	b.failed(ip, "root", now)
+	if _, banned := b.failed(ip, "root", now.Add(2*time.Minute)); banned {
+		t.Fatal("expected failures outside the window to be ignored")
+	}
+
+	// Failures of other users are counted separately
+	now = now.Add(5 * time.Minute)
+	b.failed(ip, "admin", now)
+	if _, banned := b.failed(ip, "guest", now); banned {
+		t.Fatal("expected failures to be counted per user")
+	}
+
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		b.failed(ip, "root", now)
+		ban, banned := b.failed(ip, "root", now)
+		if !banned || ban.Offences != i+1 || ban.Until.Sub(now) != expected {
+			t.Fatalf("ban %d: unexpected ban %+v", i, ban)
+		}
+		if _, ok := b.banned(ip, now); !ok {
+			t.Fatal("expected ip to be banned")
+		}
+		now = ban.Until
+		if _, ok := b.banned(ip, now); ok {
+			t.Fatal("expected ban to expire")
+		}
+	}
+}
+
+func TestBanFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := BanConfig{File: filepath.Join(dir, "bans.json")}
+
+	b, err := newBanList(conf, func(Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.add(net.ParseIP("10.0.0.1"), 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.add(net.ParseIP("10.0.0.2"), time.Hour, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.remove(net.ParseIP("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = newBanList(conf, func(Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := b.list(time.Now())
+	if len(bans) != 1 || bans[0].IP != "10.0.0.1" || !bans[0].Until.IsZero() {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+}
+
+func TestAuthFailureBan(t *testing.T) {
+	events := make(chan Event, 16)
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("invalid password")
+		},
+	}
+	srv, addr := startTestServer(t, &Config{
+		Bans:         &BanConfig{MaxFailures: 2},
+		ServerConfig: sshConfig,
+		EventHandler: func(evt Event) {
+			switch evt.(type) {
+			case *ClientBannedEvent, *ConnectionBannedEvent:
+				events <- evt
+			}
+		},
+	})
+	defer srv.Stop()
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.Password("guess"), 5)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if e, ok := (<-events).(*ClientBannedEvent); !ok || e.IP != "127.0.0.1" || e.User != "root" {
+		t.Fatalf("expected ClientBannedEvent, got %#v", e)
+	}
+	if bans := srv.Bans(); len(bans) != 1 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+
+	// Connections are rejected before the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := (<-events).(*ConnectionBannedEvent); !ok {
+		t.Fatal("expected ConnectionBannedEvent")
+	}
+
+	if err := srv.Unban(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Unban(net.ParseIP("127.0.0.1")); err == nil {
+		t.Fatal("expected error unbanning an address which is not banned")
+	}
+	if bans := srv.Bans(); len(bans) != 0 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+}
+
+func TestOfferedKeysBan(t *testing.T) {
+	userKey := newTestSigner(t)
+	banned := make(chan *ClientBannedEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		Bans: &BanConfig{MaxFailures: 2},
+		ServerConfig: &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), userKey.PublicKey().Marshal()) {
+					return nil, fmt.Errorf("unknown key")
+				}
+				return nil, nil
+			},
+			PasswordCallback: func(conn ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+				return nil, fmt.Errorf("wrong password")
+			},
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ClientBannedEvent); ok {
+				banned <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	dial := func(signers ...ssh.Signer) error {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	// Keys which are offered and refused are not failures
+	for i := 0; i < 2; i++ {
+		if err := dial(newTestSigner(t), newTestSigner(t), newTestSigner(t), userKey); err != nil {
+			t.Fatalf("expected the last key to log in, got %v", err)
+		}
+	}
+	if bans := srv.Bans(); len(bans) != 0 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+
+	// Other methods are
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.Password("guess"), 2)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("expected the password to be refused")
+	}
+	select {
+	case e := <-banned:
+		if e.IP != "127.0.0.1" || e.User != "alice" {
+			t.Fatalf("unexpected ban %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the failed passwords to ban the client")
+	}
+}
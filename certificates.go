@@ -0,0 +1,134 @@
+package shelob
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Critical options and extensions of OpenSSH user certificates.
+const (
+	certForceCommand          = "force-command"
+	certSourceAddress         = "source-address"
+	certPermitPty             = "permit-pty"
+	certPermitPortForwarding  = "permit-port-forwarding"
+	certPermitAgentForwarding = "permit-agent-forwarding"
+	certPermitX11Forwarding   = "permit-X11-forwarding"
+)
+
+// userCertificates authenticates OpenSSH user certificates signed by trusted
+// certificate authorities. Other keys are passed to the fallback callback.
+type userCertificates struct {
+	checker    *ssh.CertChecker
+	principals func(user string) []string
+	fallback   func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+func newUserCertificates(conf *Config, fallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) *userCertificates {
+	authorities := conf.UserCertificateAuthorities
+	c := &userCertificates{
+		principals: conf.CertificatePrincipals,
+		fallback:   fallback,
+	}
+	c.checker = &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, ca := range authorities {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked:                conf.IsRevoked,
+		SupportedCriticalOptions: []string{certForceCommand},
+	}
+	return c
+}
+
+// principalConnMetadata replaces the user checked against the principals of the certificate.
+type principalConnMetadata struct {
+	ssh.ConnMetadata
+	principal string
+}
+
+func (m principalConnMetadata) User() string {
+	return m.principal
+}
+
+// publicKeyCallback accepts certificates valid for one of the principals of
+// the user, and passes other keys to the fallback.
+func (c *userCertificates) publicKeyCallback(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		if c.fallback == nil {
+			return nil, errUnauthorizedKey
+		}
+		return c.fallback(meta, key)
+	}
+
+	// Certificates without principals would be valid for every user
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("ssh: certificate has no principals")
+	}
+
+	principals := []string{meta.User()}
+	if c.principals != nil {
+		principals = c.principals(meta.User())
+	}
+	err := errors.New("ssh: no principal of the certificate is authorized")
+	for _, principal := range principals {
+		var perms *ssh.Permissions
+		if perms, err = c.checker.Authenticate(principalConnMetadata{meta, principal}, key); err != nil {
+			continue
+		}
+		return certPermissions(meta, cert, perms)
+	}
+	return nil, err
+}
+
+// certPermissions copies the permissions of the certificate and adds the
+// KeyOptions the certificate restricts the connection with. The source-address
+// is checked here, as the ssh package skips it for the steps of an AuthPolicy.
+func certPermissions(meta ssh.ConnMetadata, cert *ssh.Certificate, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	_, pty := perms.Extensions[certPermitPty]
+	_, portForwarding := perms.Extensions[certPermitPortForwarding]
+	_, agentForwarding := perms.Extensions[certPermitAgentForwarding]
+	_, x11Forwarding := perms.Extensions[certPermitX11Forwarding]
+	opts := KeyOptions{
+		Command:           perms.CriticalOptions[certForceCommand],
+		NoPty:             !pty,
+		NoPortForwarding:  !portForwarding,
+		NoAgentForwarding: !agentForwarding,
+		NoX11Forwarding:   !x11Forwarding,
+	}
+	if addrs := perms.CriticalOptions[certSourceAddress]; addrs != "" {
+		opts.From = strings.Split(addrs, ",")
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		opts.ExpiryTime = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	if !opts.permits(meta.RemoteAddr(), time.Now()) {
+		return nil, errors.New("ssh: certificate is not permitted from this address")
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := &ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(perms.CriticalOptions)),
+		Extensions:      make(map[string]string, len(perms.Extensions)+1),
+	}
+	for k, v := range perms.CriticalOptions {
+		copied.CriticalOptions[k] = v
+	}
+	for k, v := range perms.Extensions {
+		copied.Extensions[k] = v
+	}
+	copied.Extensions[permKeyOptions] = string(data)
+	return copied, nil
+}
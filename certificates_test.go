@@ -0,0 +1,239 @@
+package shelob
+
+import (
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestUserCertificates(t *testing.T) {
+	ca, otherCA, userKey := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	now := time.Now()
+	newCert := func(signer ssh.Signer, serial uint64, principals []string, validBefore time.Time, perms ssh.Permissions) ssh.Signer {
+		cert := &ssh.Certificate{
+			Key:             userKey.PublicKey(),
+			Serial:          serial,
+			CertType:        ssh.UserCert,
+			KeyId:           "alice@example.com",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+			Permissions:     perms,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		certSigner, err := ssh.NewCertSigner(cert, userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certSigner
+	}
+	hour := now.Add(time.Hour)
+	pty := ssh.Permissions{Extensions: map[string]string{certPermitPty: ""}}
+
+	type result struct {
+		cmd  []string
+		cert *ssh.Certificate
+		opts *KeyOptions
+		pty  bool
+	}
+	results := make(chan result, 1)
+	srv, addr := startTestServer(t, &Config{
+		ServerConfig:               &ssh.ServerConfig{},
+		UserCertificateAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		CertificatePrincipals: func(user string) []string {
+			if user == "root" {
+				return []string{"admins"}
+			}
+			return []string{user}
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return cert.Serial == 666
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				_, _, pty := s.Pty()
+				results <- result{s.Command(), s.Certificate(), s.KeyOptions(), pty}
+				return 0
+			}, true, false),
+		},
+	})
+	defer srv.Stop()
+
+	dial := func(user string, signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	// A valid certificate is accepted and its restrictions are enforced
+	client, err := dial("alice", newCert(ca, 1, []string{"alice"}, hour, ssh.Permissions{
+		CriticalOptions: map[string]string{certForceCommand: "whoami", certSourceAddress: "127.0.0.0/8"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err == nil {
+		t.Error("expected the PTY to be refused without permit-pty")
+	}
+	if err := sess.Run("ls"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-results
+	client.Close()
+	if r.cert == nil || r.cert.KeyId != "alice@example.com" || r.cert.Serial != 1 {
+		t.Fatalf("unexpected certificate %+v", r.cert)
+	}
+	if strings.Join(r.cmd, " ") != "whoami" || r.opts == nil || !r.opts.NoPortForwarding || r.pty {
+		t.Errorf("unexpected session %+v", r)
+	}
+
+	// Principals are mapped to the user, and extensions permit features
+	client, err = dial("root", newCert(ca, 2, []string{"alice", "admins"}, hour, pty))
+	if err != nil {
+		t.Fatalf("expected the admins principal to log in as root, got %v", err)
+	}
+	sess, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Errorf("expected the PTY to be permitted, got %v", err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r.cert.Serial != 2 || !r.pty || len(r.cmd) != 0 {
+		t.Errorf("unexpected session %+v", r)
+	}
+	client.Close()
+
+	for name, signer := range map[string]ssh.Signer{
+		"wrong principal":    newCert(ca, 3, []string{"bob"}, hour, pty),
+		"no principals":      newCert(ca, 4, nil, hour, pty),
+		"expired":            newCert(ca, 5, []string{"alice"}, now.Add(-time.Second), pty),
+		"revoked":            newCert(ca, 666, []string{"alice"}, hour, pty),
+		"untrusted CA":       newCert(otherCA, 7, []string{"alice"}, hour, pty),
+		"plain key":          userKey,
+		"source address":     newCert(ca, 8, []string{"alice"}, hour, ssh.Permissions{CriticalOptions: map[string]string{certSourceAddress: "10.0.0.0/8"}}),
+		"unsupported option": newCert(ca, 9, []string{"alice"}, hour, ssh.Permissions{CriticalOptions: map[string]string{"verify-required": ""}}),
+	} {
+		if client, err := dial("alice", signer); err == nil {
+			client.Close()
+			t.Errorf("%s: expected the certificate to be refused", name)
+		}
+	}
+}
+
+func TestUserCertificateSourceAddressChained(t *testing.T) {
+	ca, userKey := newTestSigner(t), newTestSigner(t)
+	newCert := func(source string) ssh.Signer {
+		cert := &ssh.Certificate{
+			Key:             userKey.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"alice"},
+			ValidBefore:     ssh.CertTimeInfinity,
+			Permissions:     ssh.Permissions{CriticalOptions: map[string]string{certSourceAddress: source}},
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		certSigner, err := ssh.NewCertSigner(cert, userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certSigner
+	}
+
+	srv, addr := startTestServer(t, &Config{
+		ServerConfig: &ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		},
+		UserCertificateAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		AuthPolicy: func(user string) AuthPolicy {
+			return AuthPolicy{{AuthMethodPublicKey, AuthMethodPassword}}
+		},
+	})
+	defer srv.Stop()
+
+	dial := func(signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	// The source-address of a certificate is checked on a partial success too
+	if err := dial(newCert("127.0.0.0/8")); err != nil {
+		t.Fatalf("expected the chain to succeed, got %v", err)
+	}
+	if err := dial(newCert("10.0.0.0/8")); err == nil {
+		t.Fatal("expected the certificate to be refused from outside its source-address")
+	}
+}
+
+func TestUserCertificatesListener(t *testing.T) {
+	ca, userKey := newTestSigner(t), newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             userKey.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := startTestServer(t, &Config{
+		ServerConfig:               &ssh.ServerConfig{},
+		UserCertificateAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		Listeners: []ListenerConfig{{
+			Name:         "admin",
+			Listener:     admin,
+			ServerConfig: &ssh.ServerConfig{},
+			PrivateKey:   newTestSigner(t),
+		}},
+	})
+	defer srv.Stop()
+
+	// A listener with its own ServerConfig trusts the CAs too
+	client, err := ssh.Dial("tcp", admin.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("expected the certificate to be accepted, got %v", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,96 @@
+// Command shelob-passwd adds, rotates and deletes the users of a shelob
+// password file.
+//
+//	shelob-passwd [-bcrypt] file user
+//	shelob-passwd -d file user
+//
+// The password is prompted for on a terminal, or read from the first line of
+// stdin otherwise.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/eliquious/shelob"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func main() {
+	useBcrypt := flag.Bool("bcrypt", false, "hash the password with bcrypt instead of argon2id")
+	del := flag.Bool("d", false, "delete the user")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-bcrypt] [-d] file user\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	file, user := flag.Arg(0), flag.Arg(1)
+
+	if *del {
+		if err := shelob.DeletePassword(file, user); err != nil {
+			fatalf("%s", err)
+		}
+		return
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		fatalf("reading password: %s", err)
+	}
+	if password == "" {
+		fatalf("empty password")
+	}
+
+	algorithm := shelob.PasswordHashArgon2id
+	if *useBcrypt {
+		algorithm = shelob.PasswordHashBcrypt
+	}
+	hash, err := shelob.HashPassword(algorithm, password)
+	if err != nil {
+		fatalf("hashing password: %s", err)
+	}
+	if err := shelob.SetPassword(file, user, hash); err != nil {
+		fatalf("%s", err)
+	}
+}
+
+// readPassword prompts twice for the password on a terminal, or reads a line of stdin.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(confirm) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "shelob-passwd: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -13,24 +13,89 @@ import (
 // Config is used to setup the Server, including the server config and the Handlers.
 type Config struct {
 
-	// Addr specifies the bind address the SSH server will listen on.
+	// Addr specifies the bind address the SSH server will listen on. It may be
+	// left empty if Listeners are provided.
 	Addr string
 
+	// Listeners are additional listeners served by the same server. Each one
+	// can override the handlers, ssh.ServerConfig and limits of this Config.
+	Listeners []ListenerConfig
+
 	// MaxConnections is the maximum connections allowed by the server.
 	MaxConnections int
 
-	// MaxClientConnections is the maximum connections from 1 IP address.
+	// MaxClientConnections is the maximum connections from 1 client. Clients are
+	// identified by ClientKeyFunc.
 	MaxClientConnections int
 
-	// MaxDeadline is the maximum time the listener will block
-	// between connections. As a consequence, this duration
-	// also sets the max length of time the SSH server will
-	// be unresponsive before shutting down.
+	// MaxStartups randomly drops new connections while too many connections of
+	// the server are in the SSH handshake. Nil disables the limit.
+	MaxStartups *MaxStartups
+
+	// ClientKeyFunc returns the key used to count connections against
+	// MaxClientConnections. An empty key skips the limit for that connection.
+	// Defaults to IPClientKey, which only limits TCP connections by IP.
+	ClientKeyFunc func(net.Addr) string
+
+	// MaxDeadline is the maximum time the listener will back off
+	// after a temporary Accept error, such as running out of
+	// file descriptors.
 	MaxDeadline time.Duration
 
 	// MaxConnectionDuration is the maximum length of time a connection can stay open.
 	MaxConnectionDuration time.Duration
 
+	// HandshakeTimeout is the maximum length of time the SSH handshake,
+	// including authentication, may take. A disconnect message is sent to the
+	// client if the key exchange has not completed, as the ssh package cannot
+	// send one over the encrypted transport.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a connection once none of its channels have sent or
+	// received data for this long. The reason is written to the stderr of the
+	// open sessions, since the ssh package cannot send a disconnect message.
+	IdleTimeout time.Duration
+
+	// SessionIdleTimeout closes a session channel once it has not sent or
+	// received data for this long. The session's context is cancelled, and the
+	// connection is closed with the session, as when any session ends.
+	SessionIdleTimeout time.Duration
+
+	// KeepAliveInterval sends a keepalive@openssh.com request to the client
+	// this often. Zero disables keepalives.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveMaxMissed closes a connection once this many keepalives went
+	// unanswered. Defaults to 3.
+	KeepAliveMaxMissed int
+
+	// TrustedProxies enables the PROXY protocol (v1 and v2) for connections
+	// from these networks. The client address passed through by the proxy is
+	// used for the connection limits, events and sessions. Connections from
+	// other addresses are treated as direct clients.
+	TrustedProxies []*net.IPNet
+
+	// ProxyHeaderTimeout is the maximum time to wait for a PROXY protocol
+	// header from a trusted proxy. Defaults to 5 seconds.
+	ProxyHeaderTimeout time.Duration
+
+	// AllowedNetworks restricts clients to these networks if set. Connections
+	// from other addresses are rejected before the handshake.
+	AllowedNetworks []*net.IPNet
+
+	// DeniedNetworks rejects clients from these networks before the handshake.
+	// A denied network takes precedence over an allowed one.
+	DeniedNetworks []*net.IPNet
+
+	// RateLimit limits the rate of connection attempts per client address and
+	// network across all listeners. Rejected connections are closed before the
+	// handshake.
+	RateLimit *RateLimitConfig
+
+	// Bans bans client addresses which repeatedly fail authentication.
+	// Bans can be managed with Server.Ban and Server.Unban without it.
+	Bans *BanConfig
+
 	// RequestHandlers is a map of RequestHandlers which handle certain global ssh.Requests.
 	RequestHandlers map[string]RequestHandler
 
@@ -46,9 +111,137 @@ type Config struct {
 	// PrivateKey is added to the SSH config as a host key.
 	PrivateKey ssh.Signer
 
+	// AuthorizedKeysFiles authenticate public keys with OpenSSH authorized_keys
+	// files, replacing the PublicKeyCallback of the ServerConfig and of the
+	// listener ServerConfigs. A %u in the path is replaced by the user name,
+	// other files apply to all users. The files are read again when they change.
+	AuthorizedKeysFiles []string
+
+	// PasswordFile authenticates passwords with a file of user:hash lines,
+	// replacing the PasswordCallback of the ServerConfig and of the listener
+	// ServerConfigs. Hashes are argon2id or bcrypt, see HashPassword and
+	// SetPassword. The file is read again when it changes.
+	PasswordFile string
+
+	// UserCertificateAuthorities are the CA keys trusted to sign OpenSSH user
+	// certificates, on every listener. Other public keys are passed to the
+	// PublicKeyCallback of the ServerConfig, or to the AuthorizedKeysFiles.
+	UserCertificateAuthorities []ssh.PublicKey
+
+	// CertificatePrincipals returns the certificate principals which may log
+	// in as the user. Defaults to the user name only.
+	CertificatePrincipals func(user string) []string
+
+	// IsRevoked reports whether a user certificate has been revoked.
+	IsRevoked func(cert *ssh.Certificate) bool
+
+	// AuthPolicy returns the chains of authentication methods required of the
+	// user, such as a public key and then keyboard-interactive. Clients are
+	// asked for the next method of a chain with a partial success. Users
+	// without a policy are authenticated by any single method. A ServerConfig
+	// with NoClientAuth would bypass the policy, so it is an error.
+	AuthPolicy func(user string) AuthPolicy
+
 	// SignalChan recieves os.Signal for stopping the server with signals.
 	SignalChan chan os.Signal
 
+	// SignalActions maps signals received on SignalChan to actions. Signals
+	// which are not mapped stop the server.
+	SignalActions map[os.Signal]SignalAction
+
+	// ReloadFunc loads the config used by Server.Reload and the SignalReload action.
+	ReloadFunc ReloadFunc
+
+	// DrainTimeout is the graceful shutdown deadline used by the SignalDrain
+	// action. Zero waits for all the connections to close.
+	DrainTimeout time.Duration
+
+	// UpgradeCommand is the command started by Server.Upgrade. Defaults to
+	// the running executable with the same arguments.
+	UpgradeCommand []string
+
+	// UpgradeTimeout is the maximum time to wait for the new process of an
+	// upgrade to open its listeners. Defaults to 30 seconds.
+	UpgradeTimeout time.Duration
+
+	// Banner is shown to clients before authentication, eg. a legal warning.
+	// It is not used if the ssh.ServerConfig has a BannerCallback.
+	Banner string
+
+	// BannerCallback returns the banner shown to a client before
+	// authentication. It takes precedence over Banner.
+	BannerCallback func(conn ssh.ConnMetadata) string
+
+	// MOTD returns the message of the day which is written to shell sessions
+	// with a PTY before the SessionHandler runs. Exec sessions do not get it.
+	MOTD MOTDFunc
+
+	// PanicPolicy is how panics in session, channel and request handlers are
+	// handled. Defaults to PanicRecover.
+	PanicPolicy PanicPolicy
+
+	// ShutdownMessage is written to the stderr of every open session when a
+	// graceful shutdown begins.
+	ShutdownMessage string
+
 	// ServerConfig configures the underlying SSH server. It allows for full control of the authenication mechanisms.
 	ServerConfig *ssh.ServerConfig
 }
+
+// ListenerConfig configures an additional listener. Zero values inherit the
+// settings of the Config.
+type ListenerConfig struct {
+
+	// Name identifies the listener in events and handler contexts. Defaults to the Addr.
+	Name string
+
+	// Addr specifies the bind address of the listener.
+	Addr string
+
+	// Listener is an already open listener. It is used instead of Addr.
+	Listener net.Listener
+
+	// MaxConnections is the maximum connections allowed by this listener.
+	MaxConnections int
+
+	// MaxClientConnections is the maximum connections from 1 client on this listener.
+	MaxClientConnections int
+
+	// MaxConnectionDuration is the maximum length of time a connection can stay open.
+	MaxConnectionDuration time.Duration
+
+	// HandshakeTimeout is the maximum length of time the SSH handshake may take.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a connection once its channels have been idle this long.
+	IdleTimeout time.Duration
+
+	// SessionIdleTimeout closes a session channel, and its connection, once it
+	// has been idle this long.
+	SessionIdleTimeout time.Duration
+
+	// KeepAliveInterval sends keepalives to the clients of this listener this often.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveMaxMissed closes a connection of this listener once this many
+	// keepalives went unanswered.
+	KeepAliveMaxMissed int
+
+	// TrustedProxies enables the PROXY protocol for connections from these
+	// networks on this listener.
+	TrustedProxies []*net.IPNet
+
+	// RequestHandlers replaces the global request handlers for this listener.
+	RequestHandlers map[string]RequestHandler
+
+	// ChannelHandlers replaces the channel handlers for this listener.
+	ChannelHandlers map[string]ChannelHandler
+
+	// PrivateKey is added to the listener's ServerConfig as a host key. It
+	// requires ServerConfig to be set.
+	PrivateKey ssh.Signer
+
+	// ServerConfig configures the SSH server for this listener, including the
+	// authentication callbacks.
+	ServerConfig *ssh.ServerConfig
+}
@@ -0,0 +1,93 @@
+package shelob
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const keyConnState contextKey = "conn-state"
+
+// connState is the server side state of an SSH connection which is shared
+// with its channel handlers.
+type connState struct {
+	id                 string
+	listener           string
+	activity           *activity
+	sessionIdleTimeout time.Duration
+	panicPolicy        PanicPolicy
+	handleEvent        func(Event)
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+func newConnState(id, listener string, sessionIdleTimeout time.Duration, panicPolicy PanicPolicy, handleEvent func(Event)) *connState {
+	return &connState{
+		id:                 id,
+		listener:           listener,
+		activity:           newActivity(),
+		sessionIdleTimeout: sessionIdleTimeout,
+		panicPolicy:        panicPolicy,
+		handleEvent:        handleEvent,
+		sessions:           make(map[*session]struct{}),
+	}
+}
+
+func withConnState(ctx context.Context, state *connState) context.Context {
+	return context.WithValue(ctx, keyConnState, state)
+}
+
+func connStateFromContext(ctx context.Context) (*connState, bool) {
+	state, ok := ctx.Value(keyConnState).(*connState)
+	return state, ok
+}
+
+func (c *connState) addSession(s *session) {
+	c.mu.Lock()
+	c.sessions[s] = struct{}{}
+	c.mu.Unlock()
+}
+
+func (c *connState) removeSession(s *session) {
+	c.mu.Lock()
+	delete(c.sessions, s)
+	c.mu.Unlock()
+}
+
+// noticeTimeout is how long notifySessions waits for clients to accept a notice.
+var noticeTimeout = time.Second
+
+// notifySessions writes the message to the stderr of every open session. A
+// write blocks while the client is not reading, so it gives up after
+// noticeTimeout. Closing the connection ends the writes still pending.
+func (c *connState) notifySessions(msg string) {
+	c.mu.Lock()
+	sessions := make([]*session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			s.Stderr().Write([]byte(msg))
+		}(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(noticeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,201 @@
+package shelob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Reason codes of SSH_MSG_DISCONNECT of RFC 4253.
+const (
+	disconnectByApplication      = 11
+	disconnectTooManyConnections = 12
+)
+
+// handshakeTimeoutReason is sent to clients whose handshake took too long.
+const handshakeTimeoutReason = "timeout before authentication"
+
+// rejectTimeout is the maximum time spent telling a rejected client why.
+const rejectTimeout = 2 * time.Second
+
+// maxRejecting is the number of rejected clients told why at once. Others are
+// closed at once, so a flood does not hold a file descriptor for each.
+const maxRejecting = 64
+
+// defaultServerVersion is the identification of golang.org/x/crypto/ssh.
+const defaultServerVersion = "SSH-2.0-Go"
+
+// Reasons sent to clients whose connection was rejected by a limit.
+var rejectReasons = map[string]string{
+	LimitMaxConnections:       "too many connections",
+	LimitMaxClientConnections: "too many connections from your address",
+	LimitMaxStartups:          "too many unauthenticated connections",
+}
+
+// reject emits a ConnectionRejectedEvent and sends the client the SSH
+// identification and a disconnect message with the reason in the background.
+// The connection is closed without a message once stopping or while
+// maxRejecting clients are being told already.
+func (s *Server) reject(l *listener, settings *listenerSettings, conn net.Conn, limit string) {
+	reason := rejectReasons[limit]
+	s.handleEvent(&ConnectionRejectedEvent{
+		Listener:   l.name,
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+		Limit:      limit,
+		Reason:     reason,
+	})
+
+	s.connsMu.Lock()
+	if s.rejecting >= maxRejecting || s.ctx.Err() != nil || s.draining {
+		s.connsMu.Unlock()
+		conn.Close()
+		return
+	}
+	s.rejecting++
+	s.pending[conn] = struct{}{}
+	s.wg.Add(1)
+	s.connsMu.Unlock()
+
+	version := serverVersion(settings.sshConfig)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.connsMu.Lock()
+			s.rejecting--
+			delete(s.pending, conn)
+			s.connsMu.Unlock()
+		}()
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		if _, err := conn.Write(append([]byte(version+"\r\n"), disconnectPacket(disconnectTooManyConnections, reason)...)); err != nil {
+			return
+		}
+
+		// Read until the client closes, as closing with unread data resets
+		// the connection, which may discard the message on the client.
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+}
+
+// serverVersion returns the identification the server sends.
+func serverVersion(conf *ssh.ServerConfig) string {
+	if conf.ServerVersion == "" {
+		return defaultServerVersion
+	}
+	return conf.ServerVersion
+}
+
+// disconnectPacket returns an unencrypted SSH_MSG_DISCONNECT packet, which may
+// be sent before the key exchange.
+func disconnectPacket(code uint32, reason string) []byte {
+	const msgDisconnect = 1
+
+	// Message type, reason code, description and an empty language tag
+	payloadLen := 1 + 4 + 4 + len(reason) + 4
+
+	// The packet length, padding length, payload and at least 4 bytes of
+	// padding must be a multiple of 8 bytes.
+	padding := 8 - (5+payloadLen)%8
+	if padding < 4 {
+		padding += 8
+	}
+
+	packet := make([]byte, 5+payloadLen+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+payloadLen+padding))
+	packet[4] = byte(padding)
+	packet[5] = msgDisconnect
+	binary.BigEndian.PutUint32(packet[6:], code)
+	binary.BigEndian.PutUint32(packet[10:], uint32(len(reason)))
+	copy(packet[14:], reason)
+	return packet
+}
+
+// handshakeConn follows the packets the server writes until the key exchange
+// completes, so a disconnect message can be sent while they are unencrypted.
+type handshakeConn struct {
+	net.Conn
+	version string
+
+	mu          sync.Mutex
+	versionSent bool
+	header      []byte
+	remaining   int
+	encrypted   bool
+}
+
+func (c *handshakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.Conn.Write(p)
+	c.track(p[:n])
+	return n, err
+}
+
+// track parses the identification and the packet headers written so far.
+func (c *handshakeConn) track(p []byte) {
+	const msgNewKeys = 21
+	for len(p) > 0 && !c.encrypted {
+		switch {
+		case !c.versionSent:
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				return
+			}
+			c.versionSent = true
+			p = p[i+1:]
+		case c.remaining > 0:
+			n := len(p)
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			p = p[n:]
+		default:
+
+			// The length, padding length and message type
+			n := 6 - len(c.header)
+			if n > len(p) {
+				n = len(p)
+			}
+			c.header = append(c.header, p[:n]...)
+			p = p[n:]
+			if len(c.header) < 6 {
+				return
+			}
+
+			// Packets after NEWKEYS are encrypted
+			c.encrypted = c.header[5] == msgNewKeys
+			c.remaining = 4 + int(binary.BigEndian.Uint32(c.header)) - len(c.header)
+			c.header = c.header[:0]
+		}
+	}
+}
+
+// disconnect sends a disconnect message if the keys have not been changed
+// and no packet is partially written, and closes the connection. A write
+// blocked on a client which is not reading is interrupted first.
+func (c *handshakeConn) disconnect(code uint32, reason string) {
+	c.Conn.SetWriteDeadline(time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.Conn.Close()
+	if c.encrypted || c.remaining > 0 || len(c.header) > 0 {
+		return
+	}
+	var msg []byte
+	if !c.versionSent {
+		msg = []byte(c.version + "\r\n")
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	c.Conn.Write(append(msg, disconnectPacket(code, reason)...))
+}
@@ -0,0 +1,120 @@
+package shelob
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRejectedDisconnectMessage(t *testing.T) {
+	events := make(chan Event, 10)
+	srv, addr := startTestServer(t, &Config{
+		MaxClientConnections: 1,
+		EventHandler: func(evt Event) {
+			switch evt.(type) {
+			case *ConnectionRejectedEvent, *ConnectionClosedEvent:
+				events <- evt
+			}
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil || !strings.Contains(err.Error(), "too many connections from your address") {
+		t.Fatalf("expected a disconnect message, got %v", err)
+	}
+
+	select {
+	case evt := <-events:
+		e, ok := evt.(*ConnectionRejectedEvent)
+		if !ok || e.Limit != LimitMaxClientConnections || e.Reason != "too many connections from your address" {
+			t.Fatalf("unexpected event %#v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a rejection event")
+	}
+	select {
+	case evt := <-events:
+		t.Fatalf("unexpected event %#v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDisconnectPacket(t *testing.T) {
+	for _, reason := range []string{"", "a", "too many connections"} {
+		packet := disconnectPacket(disconnectTooManyConnections, reason)
+		padding := int(packet[4])
+		if len(packet)%8 != 0 || padding < 4 || int(packet[3])+4 != len(packet) {
+			t.Errorf("%q: invalid packet framing % x", reason, packet)
+		}
+		if packet[5] != 1 || packet[9] != disconnectTooManyConnections || string(packet[14:14+len(reason)]) != reason {
+			t.Errorf("%q: invalid payload % x", reason, packet)
+		}
+	}
+}
+
+func TestRejectingIsBounded(t *testing.T) {
+	srv, addr := startTestServer(t, &Config{MaxConnections: 1})
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	// Clients which never close are told why up to maxRejecting at once
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	rejecting := func() int {
+		srv.connsMu.Lock()
+		defer srv.connsMu.Unlock()
+		return srv.rejecting
+	}
+	for i := 0; i < maxRejecting; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rejecting() != maxRejecting {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients to be told why, got %d", maxRejecting, rejecting())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Others are closed without a message
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(rejectTimeout / 2))
+	if data, err := ioutil.ReadAll(conn); err != nil || len(data) != 0 {
+		t.Fatalf("expected the connection to be closed at once, got %q %v", data, err)
+	}
+
+	// Stopping closes the rejected connections and waits for them
+	srv.Stop()
+	if n := rejecting(); n != 0 {
+		t.Fatalf("expected no rejections after stopping, got %d", n)
+	}
+	conns[0].SetReadDeadline(time.Now().Add(rejectTimeout / 2))
+	if _, err := ioutil.ReadAll(conns[0]); err != nil {
+		t.Fatalf("expected the rejected connection to be closed, got %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package shelob
 import (
 	"log"
 	"net"
+	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -22,77 +24,337 @@ type ServerStartedEvent struct{}
 // ServerStoppedEvent is emitted when the server stops but before all the connections have been closed.
 type ServerStoppedEvent struct{}
 
+// DrainStartedEvent is emitted when a graceful shutdown begins and the listener
+// stops accepting connections.
+type DrainStartedEvent struct {
+	Connections int
+}
+
+// DrainProgressEvent is emitted each time a connection closes during a graceful shutdown.
+type DrainProgressEvent struct {
+	Remaining int
+}
+
+// SignalEvent is emitted when a signal is received on the Config.SignalChan.
+type SignalEvent struct {
+	Signal os.Signal
+	Action SignalAction
+}
+
+// ReloadedEvent is emitted when the config was reloaded successfully.
+type ReloadedEvent struct{}
+
+// ReloadFailedEvent is emitted when reloading the config failed. The previous config is still in use.
+type ReloadFailedEvent struct {
+	Error error
+}
+
+// UpgradeStartedEvent is emitted when the new process of an upgrade was started.
+type UpgradeStartedEvent struct {
+	PID int
+}
+
+// UpgradedEvent is emitted when the new process of an upgrade has opened its
+// listeners. The server drains next.
+type UpgradedEvent struct {
+	PID int
+}
+
+// UpgradeFailedEvent is emitted when an upgrade failed. The server keeps running.
+type UpgradeFailedEvent struct {
+	Error error
+}
+
+// StatsEvent is emitted by the SignalStats action.
+type StatsEvent struct {
+	Stats Stats
+}
+
 // ConnectionOpenedEvent is emitted when a connection is successfully established.
 type ConnectionOpenedEvent struct {
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
+}
+
+// ConnectionClosedEvent is emitted when the connection is closed. The byte
+// counters are zero for connections which were rejected.
+type ConnectionClosedEvent struct {
+	ConnectionID  string
+	Listener      string
+	LocalAddr     net.Addr
+	RemoteAddr    net.Addr
+	BytesReceived uint64
+	BytesSent     uint64
+}
+
+// ConnectionKilledEvent is emitted when a connection is force closed because
+// the graceful shutdown deadline expired.
+type ConnectionKilledEvent struct {
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
+}
+
+// ConnectionDisconnectedEvent is emitted when a connection is closed with
+// Server.Disconnect or Server.DisconnectUser.
+type ConnectionDisconnectedEvent struct {
+	ConnectionID string
+	Listener     string
+	User         string
+	Reason       string
+}
+
+// Limits reported in ConnectionRejectedEvent.
+const (
+	LimitMaxConnections       = "max-connections"
+	LimitMaxClientConnections = "max-client-connections"
+	LimitMaxStartups          = "max-startups"
+)
+
+// ConnectionRejectedEvent is emitted when a connection is rejected because the
+// listener or the client reached its connection limit, or was dropped by
+// MaxStartups. Limit is one of the Limit constants. The client is sent an SSH
+// disconnect message with the Reason. Rejected connections were never opened,
+// so no ConnectionClosedEvent follows.
+type ConnectionRejectedEvent struct {
+	Listener   string
 	LocalAddr  net.Addr
 	RemoteAddr net.Addr
+	Limit      string
+	Reason     string
 }
 
-// ConnectionClosedEvent is emitted when the connection is closed.
-type ConnectionClosedEvent struct {
+// ConnectionRateLimitedEvent is emitted when a connection is rejected because
+// the client exceeded a connection rate limit. Limit is RateLimitIP or
+// RateLimitSubnet.
+type ConnectionRateLimitedEvent struct {
+	Listener   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Limit      string
+}
+
+// ConnectionDeniedEvent is emitted when a connection is rejected because the
+// client address is denied or not allowed by the access lists.
+type ConnectionDeniedEvent struct {
+	Listener   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// ConnectionBannedEvent is emitted when a connection from a banned client is rejected.
+type ConnectionBannedEvent struct {
+	Listener   string
 	LocalAddr  net.Addr
 	RemoteAddr net.Addr
+	Until      time.Time
+}
+
+// ClientBannedEvent is emitted when a client address is banned. User is the
+// user which failed authentication, empty for bans added with Server.Ban.
+type ClientBannedEvent struct {
+	IP       string
+	User     string
+	Until    time.Time
+	Offences int
+}
+
+// ClientUnbannedEvent is emitted when a ban expires or is lifted.
+type ClientUnbannedEvent struct {
+	IP string
+}
+
+// BanFileFailedEvent is emitted when the bans could not be persisted.
+type BanFileFailedEvent struct {
+	File  string
+	Error error
 }
 
 // MaxConnectionsEvent is emitted when the maximum connection limit is reached.
 type MaxConnectionsEvent struct {
+	Listener string
 }
 
 // MaxClientConnectionsEvent is emitted when a client reaches the maximum client connection limit.
 type MaxClientConnectionsEvent struct {
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
 }
 
 // ConnectionFailedEvent is emitted when theres a connection failure.
 type ConnectionFailedEvent struct {
-	Error error
+	Listener string
+	Error    error
+}
+
+// ProxyHeaderFailedEvent is emitted when a trusted proxy sends an invalid PROXY
+// protocol header. The addresses are those of the proxy.
+type ProxyHeaderFailedEvent struct {
+	Listener   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Error      error
 }
 
 // ListenerOpenedEvent is emitted when the listener is opened.
 type ListenerOpenedEvent struct {
-	Addr *net.TCPAddr
+	Listener string
+	Addr     net.Addr
 }
 
 // ListenerClosedEvent is emitted when the listener is closed.
 type ListenerClosedEvent struct {
+	Listener string
 }
 
 // HandshakeFailedEvent is emitted when the SSH handshake failed.
 type HandshakeFailedEvent struct {
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
-	Error      error
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
+	Error        error
+}
+
+// HandshakeTimeoutEvent is emitted when the SSH handshake did not complete within the HandshakeTimeout.
+type HandshakeTimeoutEvent struct {
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
+}
+
+// AuthFailedEvent is emitted when a client fails an authentication attempt.
+// Attempts with the none method are not reported.
+type AuthFailedEvent struct {
+	ConnectionID string
+	Listener     string
+	User         string
+	Method       string
+	Error        error
 }
 
 // HandshakeSuccessfulEvent is emitted when the SSH handshake was successful.
 type HandshakeSuccessfulEvent struct {
-	LocalAddr  net.Addr
-	RemoteAddr net.Addr
+	ConnectionID string
+	Listener     string
+	LocalAddr    net.Addr
+	RemoteAddr   net.Addr
 }
 
 // RequestEvent is emitted when a gloabl request is recieved on a connection.
 type RequestEvent struct {
-	Conn        *ssh.ServerConn
-	RequestType string
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	RequestType  string
 }
 
 // UnknownRequestEvent is emitted when the global request does not have a handler.
 type UnknownRequestEvent struct {
-	Conn        *ssh.ServerConn
-	RequestType string
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	RequestType  string
 }
 
 // ChannelEvent is emitted when a channel is recieved on a connection.
 type ChannelEvent struct {
-	Conn        *ssh.ServerConn
-	ChannelType string
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	ChannelType  string
 }
 
 // UnknownChannelEvent is emitted when the channel type does not have a handler.
 type UnknownChannelEvent struct {
-	Conn        *ssh.ServerConn
-	ChannelType string
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	ChannelType  string
+}
+
+// ConnectionIdleTimeoutEvent is emitted when a connection is closed by the IdleTimeout.
+type ConnectionIdleTimeoutEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+}
+
+// KeepAliveTimeoutEvent is emitted when a connection is closed because the
+// client did not answer KeepAliveMaxMissed keepalives.
+type KeepAliveTimeoutEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	Missed       int
+}
+
+// SessionStartedEvent is emitted when the shell or command of a session is started.
+type SessionStartedEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	Command      []string
+}
+
+// SessionEndedEvent is emitted when the session handler returns.
+type SessionEndedEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	ExitCode     int
+	Duration     time.Duration
+}
+
+// SessionIdleTimeoutEvent is emitted when a session is closed by the SessionIdleTimeout.
+type SessionIdleTimeoutEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+}
+
+// HandlerPanicEvent is emitted when a session, channel or request handler
+// panicked and the panic was recovered. Handler is one of HandlerSession,
+// HandlerChannel or HandlerRequest and Type is the channel or request type.
+type HandlerPanicEvent struct {
+	ConnectionID string
+	Listener     string
+	Conn         *ssh.ServerConn
+	Handler      string
+	Type         string
+	Value        interface{}
+	Stack        []byte
+}
+
+// AuthorizedKeysFailedEvent is emitted when an authorized_keys file could not
+// be read or parsed. None of its keys are accepted until it is fixed.
+type AuthorizedKeysFailedEvent struct {
+	File  string
+	Error error
+}
+
+// PasswordFileFailedEvent is emitted when the password file could not be read
+// or parsed. No passwords are accepted until it is fixed.
+type PasswordFileFailedEvent struct {
+	File  string
+	Error error
+}
+
+// MultiEventHandler passes each event to all the handlers in order.
+func MultiEventHandler(handlers ...EventHandler) EventHandler {
+	return func(evt Event) {
+		for _, handler := range handlers {
+			if handler != nil {
+				handler(evt)
+			}
+		}
+	}
 }
 
 // LoggingEventHandler logs all the events to the standard logging interface.
@@ -103,50 +365,131 @@ func LoggingEventHandler(logger *log.Logger) EventHandler {
 			logger.Println("Server started")
 		case *ServerStoppedEvent:
 			logger.Println("Server stopped")
+		case *DrainStartedEvent:
+			logger.Printf("Server draining connections=%d\n", e.Connections)
+		case *DrainProgressEvent:
+			logger.Printf("Server draining remaining=%d\n", e.Remaining)
+		case *SignalEvent:
+			logger.Printf("Signal received signal=%s action=%s\n", e.Signal, e.Action)
+		case *ReloadedEvent:
+			logger.Println("Config reloaded")
+		case *ReloadFailedEvent:
+			logger.Printf("Config reload failed err=%s\n", e.Error)
+		case *UpgradeStartedEvent:
+			logger.Printf("Upgrade started pid=%d\n", e.PID)
+		case *UpgradedEvent:
+			logger.Printf("Upgraded pid=%d\n", e.PID)
+		case *UpgradeFailedEvent:
+			logger.Printf("Upgrade failed err=%s\n", e.Error)
+		case *StatsEvent:
+			logger.Printf("Stats connections=%d handshakes=%d draining=%t\n", e.Stats.Connections, e.Stats.Handshakes, e.Stats.Draining)
+			for _, l := range e.Stats.Listeners {
+				logger.Printf("Stats listener=%s connections=%d clients=%d\n", l.Name, l.Connections, l.Clients)
+			}
 		case *ConnectionOpenedEvent:
-			logger.Printf("Connection opened local=%s remote=%s\n", e.LocalAddr, e.RemoteAddr)
+			logger.Printf("Connection opened listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
 		case *ConnectionClosedEvent:
-			logger.Printf("Connection closed local=%s remote=%s\n", e.LocalAddr, e.RemoteAddr)
+			logger.Printf("Connection closed listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
+		case *ConnectionKilledEvent:
+			logger.Printf("Connection killed listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
+		case *ConnectionDisconnectedEvent:
+			logger.Printf("Connection disconnected listener=%s id=%s user=%s reason=%q\n", e.Listener, e.ConnectionID, e.User, e.Reason)
+		case *ConnectionRejectedEvent:
+			logger.Printf("Connection rejected listener=%s local=%s remote=%s limit=%s reason=%q\n", e.Listener, e.LocalAddr, e.RemoteAddr, e.Limit, e.Reason)
+		case *ConnectionRateLimitedEvent:
+			logger.Printf("Connection rate limited listener=%s local=%s remote=%s limit=%s\n", e.Listener, e.LocalAddr, e.RemoteAddr, e.Limit)
+		case *ConnectionDeniedEvent:
+			logger.Printf("Connection denied listener=%s local=%s remote=%s\n", e.Listener, e.LocalAddr, e.RemoteAddr)
+		case *ConnectionBannedEvent:
+			logger.Printf("Connection banned listener=%s local=%s remote=%s until=%s\n", e.Listener, e.LocalAddr, e.RemoteAddr, e.Until)
+		case *ClientBannedEvent:
+			logger.Printf("Client banned ip=%s user=%s until=%s offences=%d\n", e.IP, e.User, e.Until, e.Offences)
+		case *ClientUnbannedEvent:
+			logger.Printf("Client unbanned ip=%s\n", e.IP)
+		case *BanFileFailedEvent:
+			logger.Printf("Ban file failed file=%s err=%s\n", e.File, e.Error)
 		case *MaxConnectionsEvent:
-			logger.Println("Connection limit reached")
+			logger.Printf("Connection limit reached listener=%s\n", e.Listener)
 		case *MaxClientConnectionsEvent:
-			logger.Printf("Client connection limit reached local=%s remote=%s\n", e.LocalAddr, e.RemoteAddr)
+			logger.Printf("Client connection limit reached listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
 		case *ConnectionFailedEvent:
-			logger.Printf("Connection failed err=%s\n", e.Error)
+			logger.Printf("Connection failed listener=%s err=%s\n", e.Listener, e.Error)
+		case *ProxyHeaderFailedEvent:
+			logger.Printf("Proxy header failed listener=%s local=%s remote=%s err=%s\n", e.Listener, e.LocalAddr, e.RemoteAddr, e.Error)
 		case *ListenerOpenedEvent:
-			logger.Printf("Listener opened addr=%s\n", e.Addr)
+			logger.Printf("Listener opened listener=%s addr=%s\n", e.Listener, e.Addr)
 		case *ListenerClosedEvent:
-			logger.Println("Listener closed")
+			logger.Printf("Listener closed listener=%s\n", e.Listener)
 		case *HandshakeFailedEvent:
-			logger.Printf("Handshake failed local=%s remote=%s err=%s\n", e.LocalAddr, e.RemoteAddr, e.Error)
+			logger.Printf("Handshake failed listener=%s id=%s local=%s remote=%s err=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr, e.Error)
+		case *HandshakeTimeoutEvent:
+			logger.Printf("Handshake timeout listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
+		case *AuthFailedEvent:
+			logger.Printf("Auth failed listener=%s id=%s user=%s method=%s err=%s\n", e.Listener, e.ConnectionID, e.User, e.Method, e.Error)
 		case *HandshakeSuccessfulEvent:
-			logger.Printf("Handshake successful local=%s remote=%s\n", e.LocalAddr, e.RemoteAddr)
+			logger.Printf("Handshake successful listener=%s id=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.LocalAddr, e.RemoteAddr)
 		case *RequestEvent:
 			if e.Conn == nil {
 				logger.Printf("Global request type=%s conn=nil\n", e.RequestType)
 				return
 			}
-			logger.Printf("Global request type=%s user=%s local=%s remote=%s\n", e.RequestType, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+			logger.Printf("Global request type=%s listener=%s id=%s user=%s local=%s remote=%s\n", e.RequestType, e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
 		case *UnknownRequestEvent:
 			if e.Conn == nil {
 				logger.Printf("Unknown global request type=%s conn=nil\n", e.RequestType)
 				return
 			}
-			logger.Printf("Unknown global request type=%s user=%s local=%s remote=%s\n", e.RequestType, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+			logger.Printf("Unknown global request type=%s listener=%s id=%s user=%s local=%s remote=%s\n", e.RequestType, e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
 		case *ChannelEvent:
 
 			if e.Conn == nil {
 				logger.Printf("Channel created type=%s conn=nil\n", e.ChannelType)
 				return
 			}
-			logger.Printf("Channel created type=%s user=%s local=%s remote=%s\n", e.ChannelType, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+			logger.Printf("Channel created type=%s listener=%s id=%s user=%s local=%s remote=%s\n", e.ChannelType, e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
 		case *UnknownChannelEvent:
 
 			if e.Conn == nil {
 				logger.Printf("Unknown global request type=%s conn=nil\n", e.ChannelType)
 				return
 			}
-			logger.Printf("Unknown global request type=%s user=%s local=%s remote=%s\n", e.ChannelType, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+			logger.Printf("Unknown global request type=%s listener=%s id=%s user=%s local=%s remote=%s\n", e.ChannelType, e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+		case *ConnectionIdleTimeoutEvent:
+			if e.Conn == nil {
+				logger.Printf("Connection idle timeout listener=%s id=%s conn=nil\n", e.Listener, e.ConnectionID)
+				return
+			}
+			logger.Printf("Connection idle timeout listener=%s id=%s user=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+		case *KeepAliveTimeoutEvent:
+			if e.Conn == nil {
+				logger.Printf("Keepalive timeout listener=%s id=%s conn=nil\n", e.Listener, e.ConnectionID)
+				return
+			}
+			logger.Printf("Keepalive timeout listener=%s id=%s user=%s local=%s remote=%s missed=%d\n", e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr(), e.Missed)
+		case *SessionStartedEvent:
+			if e.Conn == nil {
+				logger.Printf("Session started listener=%s id=%s conn=nil\n", e.Listener, e.ConnectionID)
+				return
+			}
+			logger.Printf("Session started listener=%s id=%s user=%s command=%q\n", e.Listener, e.ConnectionID, e.Conn.User(), e.Command)
+		case *SessionEndedEvent:
+			if e.Conn == nil {
+				logger.Printf("Session ended listener=%s id=%s conn=nil\n", e.Listener, e.ConnectionID)
+				return
+			}
+			logger.Printf("Session ended listener=%s id=%s user=%s code=%d duration=%s\n", e.Listener, e.ConnectionID, e.Conn.User(), e.ExitCode, e.Duration)
+		case *SessionIdleTimeoutEvent:
+			if e.Conn == nil {
+				logger.Printf("Session idle timeout listener=%s id=%s conn=nil\n", e.Listener, e.ConnectionID)
+				return
+			}
+			logger.Printf("Session idle timeout listener=%s id=%s user=%s local=%s remote=%s\n", e.Listener, e.ConnectionID, e.Conn.User(), e.Conn.LocalAddr(), e.Conn.RemoteAddr())
+		case *AuthorizedKeysFailedEvent:
+			logger.Printf("Authorized keys failed file=%s err=%s\n", e.File, e.Error)
+		case *PasswordFileFailedEvent:
+			logger.Printf("Password file failed file=%s err=%s\n", e.File, e.Error)
+		case *HandlerPanicEvent:
+			logger.Printf("Handler panic listener=%s id=%s handler=%s type=%s panic=%v\n%s", e.Listener, e.ConnectionID, e.Handler, e.Type, e.Value, e.Stack)
 		default:
 		}
 	}
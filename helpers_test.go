@@ -0,0 +1,101 @@
+package shelob
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// startTestServer starts a server on a random local port and returns it with its address.
+func startTestServer(t *testing.T, conf *Config) (*Server, string) {
+	opened := make(chan string, 1)
+	handler := conf.EventHandler
+	conf.Addr = "127.0.0.1:0"
+	conf.PrivateKey = newTestSigner(t)
+	conf.EventHandler = func(evt Event) {
+		if e, ok := evt.(*ListenerOpenedEvent); ok && e.Listener == DefaultListenerName {
+			opened <- e.Addr.String()
+		}
+		if handler != nil {
+			handler(evt)
+		}
+	}
+	if conf.ServerConfig == nil {
+		conf.ServerConfig = &ssh.ServerConfig{NoClientAuth: true}
+	}
+
+	srv, err := New(context.Background(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ListenAndServe()
+
+	select {
+	case addr := <-opened:
+		return srv, addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener never opened")
+	}
+	return nil, ""
+}
+
+// dialTestServer connects to the server without authenticating.
+func dialTestServer(t *testing.T, addr string) *ssh.Client {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newTestSigner generates an ed25519 key.
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testConnMetadata is the ConnMetadata of a user, for calling auth callbacks directly.
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m testConnMetadata) User() string { return m.user }
+
+// writeHandlers returns session handlers which write the message and exit.
+func writeHandlers(msg string) map[string]ChannelHandler {
+	return map[string]ChannelHandler{
+		"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+			s.WriteString(msg)
+			return 0
+		}, false, false),
+	}
+}
+
+// sessionOutput runs a session on the client and returns its output.
+func sessionOutput(t *testing.T, client *ssh.Client) string {
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.Output("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
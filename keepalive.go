@@ -0,0 +1,54 @@
+package shelob
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+const keepAliveRequestType = "keepalive@openssh.com"
+
+// keepAlive sends a keepalive request every interval and closes the connection
+// once maxMissed requests in a row went unanswered. Any reply, including a
+// failure, shows the client is alive.
+func (s *Server) keepAlive(ctx context.Context, info *connInfo, settings *listenerSettings, sshConn *ssh.ServerConn) {
+	ticker := time.NewTicker(settings.keepAliveInterval)
+	defer ticker.Stop()
+
+	replyCh := make(chan struct{}, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-replyCh:
+			pending = false
+			missed = 0
+		case <-ticker.C:
+
+			// Only one request is outstanding at a time
+			if !pending {
+				pending = true
+				go func() {
+					if _, _, err := sshConn.SendRequest(keepAliveRequestType, true, nil); err == nil {
+						replyCh <- struct{}{}
+					}
+				}()
+				continue
+			}
+
+			if missed++; missed >= settings.keepAliveMaxMissed {
+				s.handleEvent(&KeepAliveTimeoutEvent{
+					ConnectionID: info.id,
+					Listener:     info.listener.name,
+					Conn:         sshConn,
+					Missed:       missed,
+				})
+				sshConn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package shelob
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// freezableConn stops reading once frozen, like a client whose network dropped.
+type freezableConn struct {
+	net.Conn
+	frozen    chan struct{}
+	closed    chan struct{}
+	freezeOne sync.Once
+	closeOnce sync.Once
+}
+
+func newFreezableConn(conn net.Conn) *freezableConn {
+	return &freezableConn{Conn: conn, frozen: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *freezableConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.frozen:
+		<-c.closed
+		return 0, io.EOF
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *freezableConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *freezableConn) freeze() {
+	c.freezeOne.Do(func() { close(c.frozen) })
+}
+
+func TestKeepAlive(t *testing.T) {
+	events := make(chan *KeepAliveTimeoutEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		KeepAliveInterval:  20 * time.Millisecond,
+		KeepAliveMaxMissed: 2,
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*KeepAliveTimeoutEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newFreezableConn(tcpConn)
+	defer conn.Close()
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	defer client.Close()
+
+	// Answered keepalives keep the connection open
+	select {
+	case <-events:
+		t.Fatal("unexpected KeepAliveTimeoutEvent")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conn.freeze()
+	select {
+	case e := <-events:
+		if e.Missed != 2 {
+			t.Fatalf("unexpected missed keepalives %d", e.Missed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected KeepAliveTimeoutEvent")
+	}
+
+	// The client counters are released
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Stats().Connections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if clients := srv.Stats().Listeners[0].Clients; clients != 0 {
+		t.Fatalf("expected no clients, got %d", clients)
+	}
+}
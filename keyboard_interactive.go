@@ -0,0 +1,85 @@
+package shelob
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authentication methods recorded for the connection, see Session.AuthMethod.
+const (
+	AuthMethodNone                = "none"
+	AuthMethodPassword            = "password"
+	AuthMethodPublicKey           = "publickey"
+	AuthMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+const permAuthMethod = "auth-method"
+
+// Question is a prompt of keyboard-interactive authentication. Echo shows the
+// answer as it is typed, and should be false for secrets.
+type Question struct {
+	Prompt string
+	Echo   bool
+}
+
+// KeyboardInteractiveVerifier verifies the answers to the questions, in the
+// order they were asked.
+type KeyboardInteractiveVerifier func(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error)
+
+var errInvalidAnswers = errors.New("ssh: invalid keyboard-interactive answers")
+
+// keyboardInteractiveCallback asks the questions with the instruction and
+// passes the answers to the verifier.
+func keyboardInteractiveCallback(instruction string, questions []Question, verify KeyboardInteractiveVerifier) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	prompts := make([]string, len(questions))
+	echos := make([]bool, len(questions))
+	for i, q := range questions {
+		prompts[i], echos[i] = q.Prompt, q.Echo
+	}
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(conn.User(), instruction, prompts, echos)
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != len(questions) {
+			return nil, errInvalidAnswers
+		}
+		return verify(conn, answers)
+	}
+}
+
+// withAuthMethod records the authentication method in the permissions.
+func withAuthMethod(perms *ssh.Permissions, method string) *ssh.Permissions {
+	if perms == nil {
+		perms = &ssh.Permissions{}
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+	perms.Extensions[permAuthMethod] = method
+	return perms
+}
+
+// authMethodWrapper wraps the authentication callbacks of the config to record
+// the method which authenticated the connection.
+func authMethodWrapper(sshConfig *ssh.ServerConfig) {
+	if cb := sshConfig.PasswordCallback; cb != nil {
+		sshConfig.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := cb(conn, password)
+			if err != nil {
+				return nil, err
+			}
+			return withAuthMethod(perms, AuthMethodPassword), nil
+		}
+	}
+	if cb := sshConfig.KeyboardInteractiveCallback; cb != nil {
+		sshConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			perms, err := cb(conn, client)
+			if err != nil {
+				return nil, err
+			}
+			return withAuthMethod(perms, AuthMethodKeyboardInteractive), nil
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package shelob
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultListenerName is the name of the listener created from Config.Addr.
+const DefaultListenerName = "default"
+
+// listener is a single accepting socket and the settings used for the
+// connections which arrive on it.
+type listener struct {
+	net.Listener
+	name string
+	addr string
+
+	// settings are replaced when the config is reloaded. Connections keep
+	// the settings they were accepted with. Guarded by Server.connsMu.
+	settings *listenerSettings
+
+	// Connection counters, guarded by Server.connsMu.
+	conns   int
+	clients map[string]int
+}
+
+// listenerSettings are the reloadable settings of a listener.
+type listenerSettings struct {
+	sshConfig       *ssh.ServerConfig
+	requestHandlers map[string]RequestHandler
+	channelHandlers map[string]ChannelHandler
+
+	maxConnections        int
+	maxClientConnections  int
+	maxConnectionDuration time.Duration
+	handshakeTimeout      time.Duration
+	idleTimeout           time.Duration
+	sessionIdleTimeout    time.Duration
+	keepAliveInterval     time.Duration
+	keepAliveMaxMissed    int
+	trustedProxies        []*net.IPNet
+	bannerCallback        func(ssh.ConnMetadata) string
+	motd                  MOTDFunc
+}
+
+// newListeners validates the config and creates the default listener and the
+// listeners in conf.Listeners. The default listener is skipped if conf.Addr is
+// empty and other listeners are configured.
+func newListeners(conf *Config, handleEvent func(Event)) ([]*listener, error) {
+
+	// ServerConfig is required.
+	if conf.ServerConfig == nil {
+		return nil, fmt.Errorf("ssh.ServerConfig must be provided")
+	}
+
+	// The callbacks are wrapped on copies of the ServerConfigs, so a config
+	// returned again by a ReloadFunc is not wrapped twice.
+	copies := make(map[*ssh.ServerConfig]*ssh.ServerConfig)
+	copyConfig := func(sshConfig *ssh.ServerConfig) *ssh.ServerConfig {
+		if c, ok := copies[sshConfig]; ok {
+			return c
+		}
+		c := *sshConfig
+		copies[sshConfig] = &c
+		return &c
+	}
+	conf.ServerConfig = copyConfig(conf.ServerConfig)
+
+	// Add private key to ServerConfig
+	if conf.PrivateKey != nil {
+		conf.ServerConfig.AddHostKey(conf.PrivateKey)
+	}
+
+	var listeners []*listener
+	if conf.Addr != "" || len(conf.Listeners) == 0 {
+		listeners = append(listeners, newListener(conf, ListenerConfig{
+			Name: DefaultListenerName,
+			Addr: conf.Addr,
+		}))
+	}
+
+	names := make(map[string]bool)
+	for _, lc := range conf.Listeners {
+		if lc.Name == "" {
+			lc.Name = lc.Addr
+			if lc.Listener != nil {
+				lc.Name = lc.Listener.Addr().String()
+			}
+		}
+		if names[lc.Name] || lc.Name == DefaultListenerName {
+			return nil, fmt.Errorf("listener %q: duplicate listener name", lc.Name)
+		}
+		names[lc.Name] = true
+
+		// A listener specific host key is added to the listener specific ServerConfig.
+		if lc.PrivateKey != nil && lc.ServerConfig == nil {
+			return nil, fmt.Errorf("listener %q: PrivateKey requires a ServerConfig", lc.Name)
+		}
+		if lc.ServerConfig != nil {
+			lc.ServerConfig = copyConfig(lc.ServerConfig)
+		}
+		if lc.PrivateKey != nil {
+			lc.ServerConfig.AddHostKey(lc.PrivateKey)
+		}
+		listeners = append(listeners, newListener(conf, lc))
+	}
+
+	// The authenticators are shared by the ServerConfigs of the listeners
+	var authorized *authorizedKeys
+	if len(conf.AuthorizedKeysFiles) > 0 {
+		authorized = newAuthorizedKeys(conf.AuthorizedKeysFiles, handleEvent)
+	}
+	var passwords *passwordFile
+	if conf.PasswordFile != "" {
+		passwords = newPasswordFile(conf.PasswordFile, handleEvent)
+	}
+
+	// Wrap provided auth callbacks to inject permission extensions for
+	// getting the public key information and auth method in the session.
+	sshConfigs := []*ssh.ServerConfig{conf.ServerConfig}
+	for _, l := range listeners {
+		sshConfigs = append(sshConfigs, l.settings.sshConfig)
+	}
+	wrapped := make(map[*ssh.ServerConfig]bool)
+	for _, sshConfig := range sshConfigs {
+		if wrapped[sshConfig] {
+			continue
+		}
+		wrapped[sshConfig] = true
+
+		// NoClientAuth skips the callbacks which enforce the policy
+		if conf.AuthPolicy != nil && sshConfig.NoClientAuth {
+			return nil, fmt.Errorf("AuthPolicy cannot be enforced with NoClientAuth")
+		}
+
+		// Authenticate public keys with the authorized_keys files
+		if authorized != nil {
+			sshConfig.PublicKeyCallback = authorized.publicKeyCallback
+		}
+
+		// Authenticate passwords with the password file
+		if passwords != nil {
+			sshConfig.PasswordCallback = passwords.passwordCallback
+		}
+
+		// Authenticate user certificates, passing other keys to the public key callback
+		if len(conf.UserCertificateAuthorities) > 0 {
+			sshConfig.PublicKeyCallback = newUserCertificates(conf, sshConfig.PublicKeyCallback).publicKeyCallback
+		}
+
+		if sshConfig.PublicKeyCallback != nil {
+			sshConfig.PublicKeyCallback = pubKeyCallbackWrapper(sshConfig.PublicKeyCallback)
+		}
+		authMethodWrapper(sshConfig)
+		if conf.AuthPolicy != nil {
+			authPolicyWrapper(sshConfig, conf.AuthPolicy)
+		}
+	}
+	return listeners, nil
+}
+
+// newListener resolves the listener settings, falling back to the Config for
+// any which are not set.
+func newListener(conf *Config, lc ListenerConfig) *listener {
+	settings := &listenerSettings{
+		sshConfig:             lc.ServerConfig,
+		requestHandlers:       lc.RequestHandlers,
+		channelHandlers:       lc.ChannelHandlers,
+		maxConnections:        lc.MaxConnections,
+		maxClientConnections:  lc.MaxClientConnections,
+		maxConnectionDuration: lc.MaxConnectionDuration,
+		handshakeTimeout:      lc.HandshakeTimeout,
+		idleTimeout:           lc.IdleTimeout,
+		sessionIdleTimeout:    lc.SessionIdleTimeout,
+		keepAliveInterval:     lc.KeepAliveInterval,
+		keepAliveMaxMissed:    lc.KeepAliveMaxMissed,
+		trustedProxies:        lc.TrustedProxies,
+		bannerCallback:        conf.BannerCallback,
+		motd:                  conf.MOTD,
+	}
+	if settings.sshConfig == nil {
+		settings.sshConfig = conf.ServerConfig
+	}
+	if settings.requestHandlers == nil {
+		settings.requestHandlers = conf.RequestHandlers
+	}
+	if settings.channelHandlers == nil {
+		settings.channelHandlers = conf.ChannelHandlers
+	}
+	if settings.maxConnections == 0 {
+		settings.maxConnections = conf.MaxConnections
+	}
+	if settings.maxClientConnections == 0 {
+		settings.maxClientConnections = conf.MaxClientConnections
+	}
+	if settings.maxConnectionDuration == 0 {
+		settings.maxConnectionDuration = conf.MaxConnectionDuration
+	}
+	if settings.handshakeTimeout == 0 {
+		settings.handshakeTimeout = conf.HandshakeTimeout
+	}
+	if settings.idleTimeout == 0 {
+		settings.idleTimeout = conf.IdleTimeout
+	}
+	if settings.sessionIdleTimeout == 0 {
+		settings.sessionIdleTimeout = conf.SessionIdleTimeout
+	}
+	if settings.keepAliveInterval == 0 {
+		settings.keepAliveInterval = conf.KeepAliveInterval
+	}
+	if settings.keepAliveMaxMissed == 0 {
+		settings.keepAliveMaxMissed = conf.KeepAliveMaxMissed
+	}
+	if settings.keepAliveMaxMissed == 0 {
+		settings.keepAliveMaxMissed = 3
+	}
+	if settings.trustedProxies == nil {
+		settings.trustedProxies = conf.TrustedProxies
+	}
+	if settings.bannerCallback == nil && conf.Banner != "" {
+		settings.bannerCallback = staticBanner(conf.Banner)
+	}
+
+	return &listener{
+		Listener: lc.Listener,
+		name:     lc.Name,
+		addr:     lc.Addr,
+		settings: settings,
+		clients:  make(map[string]int),
+	}
+}
+
+// open creates the TCP listener if one was not provided.
+func (l *listener) open() error {
+	if l.Listener != nil {
+		return nil
+	}
+
+	// Validate the ssh bind addr
+	addr := l.addr
+	if addr == "" {
+		addr = ":22"
+	}
+
+	// Open SSH socket listener
+	sshAddr, e := net.ResolveTCPAddr("tcp", addr)
+	if e != nil {
+		return fmt.Errorf("ssh server: Invalid tcp address")
+	}
+
+	// Create listener
+	tcpListener, err := net.ListenTCP("tcp", sshAddr)
+	if err != nil {
+		return err
+	}
+	l.Listener = tcpListener
+	return nil
+}
@@ -0,0 +1,233 @@
+package shelob
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxLabelValues caps the number of distinct client controlled label values,
+// such as unknown channel and request types, of a metric. Further values are
+// counted as "other".
+const maxLabelValues = 64
+
+// sessionDurationBuckets are the upper bounds of the session duration histogram in seconds.
+var sessionDurationBuckets = []float64{1, 5, 10, 30, 60, 300, 900, 1800, 3600, 14400, 86400}
+
+type metricDesc struct {
+	name string
+	typ  string
+	help string
+}
+
+var metricDescs = []metricDesc{
+	{"shelob_connections_open", "gauge", "Number of open connections."},
+	{"shelob_connections_total", "counter", "Total number of accepted connections."},
+	{"shelob_connections_rejected_total", "counter", "Total number of connections rejected before the handshake by reason."},
+	{"shelob_handshakes_total", "counter", "Total number of SSH handshakes by result."},
+	{"shelob_auth_failures_total", "counter", "Total number of failed authentication attempts by method."},
+	{"shelob_sessions_open", "gauge", "Number of running sessions."},
+	{"shelob_sessions_total", "counter", "Total number of started sessions."},
+	{"shelob_session_exit_codes_total", "counter", "Total number of ended sessions by exit code."},
+	{"shelob_session_duration_seconds", "histogram", "Duration of ended sessions."},
+	{"shelob_channels_total", "counter", "Total number of channels by type."},
+	{"shelob_unknown_channels_total", "counter", "Total number of channels without a handler by type."},
+	{"shelob_requests_total", "counter", "Total number of global requests by type."},
+	{"shelob_unknown_requests_total", "counter", "Total number of global requests without a handler by type."},
+	{"shelob_handler_panics_total", "counter", "Total number of recovered handler panics by handler kind."},
+	{"shelob_received_bytes_total", "counter", "Total number of bytes received on closed connections."},
+	{"shelob_sent_bytes_total", "counter", "Total number of bytes sent on closed connections."},
+}
+
+// Metrics collects server metrics from events and serves them in the
+// Prometheus text format. Use HandleEvent as, or from, the EventHandler.
+type Metrics struct {
+	mu          sync.Mutex
+	values      map[string]map[string]float64
+	histograms  map[string]*histogram
+	labelValues map[string]map[string]bool
+}
+
+// NewMetrics creates an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		values:      make(map[string]map[string]float64),
+		histograms:  make(map[string]*histogram),
+		labelValues: make(map[string]map[string]bool),
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range sessionDurationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HandleEvent updates the metrics from a server event.
+func (m *Metrics) HandleEvent(evt Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e := evt.(type) {
+	case *ConnectionOpenedEvent:
+		m.add("shelob_connections_open", 1, "listener", e.Listener)
+		m.add("shelob_connections_total", 1, "listener", e.Listener)
+	case *ConnectionClosedEvent:
+		m.add("shelob_connections_open", -1, "listener", e.Listener)
+		m.add("shelob_received_bytes_total", float64(e.BytesReceived), "listener", e.Listener)
+		m.add("shelob_sent_bytes_total", float64(e.BytesSent), "listener", e.Listener)
+	case *ConnectionRejectedEvent:
+		m.add("shelob_connections_rejected_total", 1, "listener", e.Listener, "reason", e.Limit)
+	case *ConnectionRateLimitedEvent:
+		m.add("shelob_connections_rejected_total", 1, "listener", e.Listener, "reason", "rate-limit-"+e.Limit)
+	case *ConnectionBannedEvent:
+		m.add("shelob_connections_rejected_total", 1, "listener", e.Listener, "reason", "banned")
+	case *ConnectionDeniedEvent:
+		m.add("shelob_connections_rejected_total", 1, "listener", e.Listener, "reason", "denied")
+	case *HandshakeSuccessfulEvent:
+		m.add("shelob_handshakes_total", 1, "listener", e.Listener, "result", "success")
+	case *HandshakeFailedEvent:
+		m.add("shelob_handshakes_total", 1, "listener", e.Listener, "result", "failure")
+	case *HandshakeTimeoutEvent:
+		m.add("shelob_handshakes_total", 1, "listener", e.Listener, "result", "timeout")
+	case *AuthFailedEvent:
+		m.add("shelob_auth_failures_total", 1, "listener", e.Listener, "method", m.limit("shelob_auth_failures_total", e.Method))
+	case *SessionStartedEvent:
+		m.add("shelob_sessions_open", 1, "listener", e.Listener)
+		m.add("shelob_sessions_total", 1, "listener", e.Listener)
+	case *SessionEndedEvent:
+		m.add("shelob_sessions_open", -1, "listener", e.Listener)
+		m.add("shelob_session_exit_codes_total", 1, "listener", e.Listener, "code", strconv.Itoa(e.ExitCode))
+		m.observe("shelob_session_duration_seconds", e.Duration.Seconds(), "listener", e.Listener)
+	case *ChannelEvent:
+		m.add("shelob_channels_total", 1, "listener", e.Listener, "type", e.ChannelType)
+	case *UnknownChannelEvent:
+		m.add("shelob_unknown_channels_total", 1, "listener", e.Listener, "type", m.limit("shelob_unknown_channels_total", e.ChannelType))
+	case *RequestEvent:
+		m.add("shelob_requests_total", 1, "listener", e.Listener, "type", e.RequestType)
+	case *UnknownRequestEvent:
+		m.add("shelob_unknown_requests_total", 1, "listener", e.Listener, "type", m.limit("shelob_unknown_requests_total", e.RequestType))
+	case *HandlerPanicEvent:
+		m.add("shelob_handler_panics_total", 1, "listener", e.Listener, "handler", e.Handler)
+	}
+}
+
+// add adds the value to the series of the metric. Guarded by mu.
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+	series[formatLabels(labels...)] += v
+}
+
+// observe adds the value to the histogram of the metric. Guarded by mu.
+func (m *Metrics) observe(name string, v float64, labels ...string) {
+	key := name + "{" + formatLabels(labels...) + "}"
+	h, ok := m.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(sessionDurationBuckets))}
+		m.histograms[key] = h
+	}
+	h.observe(v)
+}
+
+// limit returns the client controlled label value, or "other" once the metric
+// has seen too many distinct values. Guarded by mu.
+func (m *Metrics) limit(name, value string) string {
+	seen, ok := m.labelValues[name]
+	if !ok {
+		seen = make(map[string]bool)
+		m.labelValues[name] = seen
+	}
+	if !seen[value] {
+		if len(seen) >= maxLabelValues {
+			return "other"
+		}
+		seen[value] = true
+	}
+	return value
+}
+
+// formatLabels formats the label name and value pairs.
+func formatLabels(labels ...string) string {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", labels[i], labelEscaper.Replace(strings.ToValidUTF8(labels[i+1], "\uFFFD")))
+	}
+	return buf.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// write writes the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, desc := range metricDescs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, desc.typ)
+		if desc.typ == "histogram" {
+			m.writeHistograms(w, desc.name)
+			continue
+		}
+
+		series := m.values[desc.name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{%s} %s\n", desc.name, key, strconv.FormatFloat(series[key], 'g', -1, 64))
+		}
+	}
+}
+
+func (m *Metrics) writeHistograms(w io.Writer, name string) {
+	keys := make([]string, 0, len(m.histograms))
+	for key := range m.histograms {
+		if strings.HasPrefix(key, name+"{") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := m.histograms[key]
+		labels := strings.TrimSuffix(strings.TrimPrefix(key, name+"{"), "}")
+		for i, bound := range sessionDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,74 @@
+package shelob
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	srv, addr := startTestServer(t, &Config{
+		ChannelHandlers: writeHandlers("hello"),
+		EventHandler:    m.HandleEvent,
+	})
+
+	client := dialTestServer(t, addr)
+	client.OpenChannel("unknown", nil)
+	if out := sessionOutput(t, client); out != "hello" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	client.Close()
+	srv.Stop()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	for _, expected := range []string{
+		`# TYPE shelob_connections_open gauge`,
+		`shelob_connections_open{listener="default"} 0`,
+		`shelob_connections_total{listener="default"} 1`,
+		`shelob_handshakes_total{listener="default",result="success"} 1`,
+		`shelob_sessions_open{listener="default"} 0`,
+		`shelob_session_exit_codes_total{listener="default",code="0"} 1`,
+		`shelob_session_duration_seconds_bucket{listener="default",le="+Inf"} 1`,
+		`shelob_session_duration_seconds_count{listener="default"} 1`,
+		`shelob_channels_total{listener="default",type="session"} 1`,
+		`shelob_unknown_channels_total{listener="default",type="unknown"} 1`,
+	} {
+		if !strings.Contains(string(body), expected+"\n") {
+			t.Errorf("expected %s in:\n%s", expected, body)
+		}
+	}
+	if !strings.Contains(string(body), `shelob_received_bytes_total{listener="default"} `) {
+		t.Error("expected received bytes")
+	}
+}
+
+func TestMetricsRejections(t *testing.T) {
+	m := NewMetrics()
+	m.HandleEvent(&ConnectionRejectedEvent{Listener: "default", Limit: LimitMaxConnections})
+	m.HandleEvent(&AuthFailedEvent{Listener: "default", Method: "password"})
+	m.HandleEvent(&SessionEndedEvent{Listener: "default", ExitCode: 1, Duration: 2 * time.Second})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`shelob_connections_rejected_total{listener="default",reason="max-connections"} 1`,
+		`shelob_auth_failures_total{listener="default",method="password"} 1`,
+		`shelob_session_duration_seconds_bucket{listener="default",le="1"} 0`,
+		`shelob_session_duration_seconds_bucket{listener="default",le="5"} 1`,
+		`shelob_session_duration_seconds_sum{listener="default"} 2`,
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Errorf("expected %s in:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `shelob_connections_open{`) {
+		t.Error("expected rejected connections not to change the open connections")
+	}
+}
@@ -0,0 +1,44 @@
+package shelob
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+const keyMOTD contextKey = "motd"
+
+// MOTDFunc returns the message of the day shown to the user of an interactive
+// session, eg. depending on the user or the Permissions of the session. An
+// empty message is not shown.
+type MOTDFunc func(ctx context.Context, s Session) string
+
+// staticBanner returns a BannerCallback which always shows the banner.
+func staticBanner(banner string) func(ssh.ConnMetadata) string {
+	return func(ssh.ConnMetadata) string {
+		return banner
+	}
+}
+
+func withMOTD(ctx context.Context, motd MOTDFunc) context.Context {
+	if motd == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, keyMOTD, motd)
+}
+
+// writeMOTD writes the message of the day to a shell session with a PTY. The
+// line endings are converted for the terminal.
+func (s *session) writeMOTD(ctx context.Context) {
+	motd, ok := ctx.Value(keyMOTD).(MOTDFunc)
+	if !ok {
+		return
+	}
+	msg := motd(ctx, s)
+	if msg == "" {
+		return
+	}
+	msg = strings.Replace(strings.Replace(msg, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	s.Write([]byte(msg))
+}
@@ -0,0 +1,96 @@
+package shelob
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestBannerAndMOTD(t *testing.T) {
+	srv, addr := startTestServer(t, &Config{
+		Banner: "Authorized use only\n",
+		MOTD: func(ctx context.Context, s Session) string {
+			if s.User() == "root" {
+				return ""
+			}
+			return "Welcome " + s.User() + "\nHave fun\n"
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				s.Write([]byte("$ "))
+				return 0
+			}, true, false),
+		},
+	})
+	defer srv.Stop()
+
+	dial := func(user string) (*ssh.Client, string) {
+		var banner string
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            user,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			BannerCallback: func(msg string) error {
+				banner = msg
+				return nil
+			},
+			Timeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, banner
+	}
+	run := func(client *ssh.Client, pty bool, cmd string) string {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		if pty {
+			if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var stdout bytes.Buffer
+		sess.Stdout = &stdout
+		if cmd == "" {
+			err = sess.Shell()
+		} else {
+			err = sess.Start(cmd)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+
+	tests := []struct {
+		user     string
+		pty      bool
+		cmd      string
+		expected string
+	}{
+		{"alice", true, "", "Welcome alice\r\nHave fun\r\n$ "},
+		{"alice", true, "ls", "$ "},
+		{"alice", false, "", "$ "},
+		{"root", true, "", "$ "},
+	}
+	for _, tt := range tests {
+
+		// The session handler closes the connection, so dial for every session
+		client, banner := dial(tt.user)
+		if banner != "Authorized use only\n" {
+			t.Errorf("unexpected banner %q", banner)
+		}
+		if out := run(client, tt.pty, tt.cmd); out != tt.expected {
+			t.Errorf("user=%s pty=%v cmd=%q: expected %q, got %q", tt.user, tt.pty, tt.cmd, tt.expected, out)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package shelob
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PanicPolicy is how the server handles a panic in a session, channel or request handler.
+type PanicPolicy int
+
+const (
+	// PanicRecover recovers the panic and ends the session, channel or request
+	// which panicked. Other channels of the connection keep running. This is
+	// the default policy.
+	PanicRecover PanicPolicy = iota
+
+	// PanicCloseConnection recovers the panic and closes the connection of
+	// the handler which panicked.
+	PanicCloseConnection
+
+	// PanicCrash does not recover, so a panic stops the process.
+	PanicCrash
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicRecover:
+		return "recover"
+	case PanicCloseConnection:
+		return "close-connection"
+	case PanicCrash:
+		return "crash"
+	default:
+		return fmt.Sprintf("PanicPolicy(%d)", int(p))
+	}
+}
+
+// Handler kinds of a HandlerPanicEvent.
+const (
+	HandlerSession = "session"
+	HandlerChannel = "channel"
+	HandlerRequest = "request"
+)
+
+// panicMessage is written to the stderr of a session whose handler panicked.
+const panicMessage = "Internal server error.\r\n"
+
+// panicExitSignal is sent to the client when a session handler panics. Clients
+// report it as exit status 134.
+const panicExitSignal = "ABRT"
+
+// recovers reports whether handler panics are recovered.
+func (c *connState) recovers() bool {
+	return c.panicPolicy != PanicCrash
+}
+
+// panicked reports a recovered panic of a handler and applies the panic
+// policy. It must be called from the deferred function which recovered.
+func (c *connState) panicked(conn *ssh.ServerConn, handler, typ string, value interface{}) {
+	if c.handleEvent != nil {
+		c.handleEvent(&HandlerPanicEvent{
+			ConnectionID: c.id,
+			Listener:     c.listener,
+			Conn:         conn,
+			Handler:      handler,
+			Type:         typ,
+			Value:        value,
+			Stack:        debug.Stack(),
+		})
+	}
+	if c.panicPolicy == PanicCloseConnection && conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package shelob
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+type panicRequestHandler struct{}
+
+func (panicRequestHandler) HandleRequest(ctx context.Context, req *ssh.Request) (bool, []byte) {
+	panic("request")
+}
+
+type panicChannelHandler struct{}
+
+func (panicChannelHandler) HandleChannel(ctx context.Context, newch ssh.NewChannel) {
+	panic("channel")
+}
+
+func newPanicConfig(policy PanicPolicy, events chan *HandlerPanicEvent) *Config {
+	return &Config{
+		PanicPolicy: policy,
+		RequestHandlers: map[string]RequestHandler{
+			"panic": panicRequestHandler{},
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"panic": panicChannelHandler{},
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				if len(s.Command()) > 0 && s.Command()[0] == "panic" {
+					panic("session")
+				}
+				s.Write([]byte("ok"))
+				return 0
+			}, false, false),
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*HandlerPanicEvent); ok {
+				events <- e
+			}
+		},
+	}
+}
+
+func expectPanicEvent(t *testing.T, events chan *HandlerPanicEvent, handler, typ, value string) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Handler != handler || e.Type != typ || e.Value != value || e.ConnectionID == "" || e.Conn == nil {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if !strings.Contains(string(e.Stack), "panic_test.go") {
+			t.Fatalf("expected the stack of the panic, got %s", e.Stack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the %s panic", handler)
+	}
+}
+
+func TestHandlerPanicRecover(t *testing.T) {
+	events := make(chan *HandlerPanicEvent, 3)
+	srv, addr := startTestServer(t, newPanicConfig(PanicRecover, events))
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	// A request fails, and the connection stays open
+	ok, _, err := client.SendRequest("panic", true, nil)
+	if err != nil || ok {
+		t.Fatalf("expected the request to fail, got ok=%v err=%v", ok, err)
+	}
+	expectPanicEvent(t, events, HandlerRequest, "panic", "request")
+
+	// A channel is rejected
+	if _, _, err := client.OpenChannel("panic", nil); err == nil {
+		t.Fatal("expected the channel to be rejected")
+	}
+	expectPanicEvent(t, events, HandlerChannel, "panic", "channel")
+
+	// A session exits with a signal
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	sess.Stderr = &stderr
+	err = sess.Run("panic")
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok || exitErr.Signal() != panicExitSignal || exitErr.ExitStatus() == 0 {
+		t.Fatalf("expected the session to exit with a signal, got %v", err)
+	}
+	if stderr.String() != panicMessage {
+		t.Fatalf("unexpected stderr %q", stderr.String())
+	}
+	expectPanicEvent(t, events, HandlerSession, "session", "session")
+
+	// Other connections keep being served
+	other := dialTestServer(t, addr)
+	defer other.Close()
+	sess, err = other.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := sess.Output("hello"); err != nil || string(out) != "ok" {
+		t.Fatalf("unexpected output %q err=%v", out, err)
+	}
+}
+
+func TestHandlerPanicCloseConnection(t *testing.T) {
+	events := make(chan *HandlerPanicEvent, 1)
+	srv, addr := startTestServer(t, newPanicConfig(PanicCloseConnection, events))
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	client.SendRequest("panic", true, nil)
+	expectPanicEvent(t, events, HandlerRequest, "panic", "request")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
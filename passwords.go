@@ -0,0 +1,384 @@
+package shelob
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Password hash algorithms supported by HashPassword and password files.
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+// Parameters of new argon2id hashes.
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Limits of the parameters of argon2id hashes, so a hash in a password file
+// cannot make every login take gigabytes of memory or minutes of work.
+const (
+	maxArgon2Memory  = 1024 * 1024
+	maxArgon2Time    = 16
+	maxArgon2Threads = 64
+)
+
+var errInvalidPassword = errors.New("Invalid username or password")
+
+// HashPassword hashes the password with the algorithm, PasswordHashArgon2id or
+// PasswordHashBcrypt, in the format of password files.
+func HashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case PasswordHashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		return argon2Hash{argon2.Version, argon2Memory, argon2Time, argon2Threads, salt, nil}.hash(password), nil
+	case PasswordHashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+	return "", fmt.Errorf("unsupported password hash %q", algorithm)
+}
+
+// argon2Hash is an argon2id hash in the PHC string format:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+type argon2Hash struct {
+	version uint32
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(s string) (argon2Hash, error) {
+	var h argon2Hash
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return h, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil || h.version != argon2.Version {
+		return h, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil || h.time == 0 || h.threads == 0 {
+		return h, errors.New("invalid argon2id parameters")
+	}
+	if h.memory > maxArgon2Memory || h.time > maxArgon2Time || h.threads > maxArgon2Threads {
+		return h, errors.New("argon2id parameters too large")
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, errors.New("invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errors.New("invalid argon2id key")
+	}
+	return h, nil
+}
+
+// hash hashes the password with the parameters and salt of h.
+func (h argon2Hash) hash(password string) string {
+	keyLen := uint32(len(h.key))
+	if keyLen == 0 {
+		keyLen = argon2KeyLen
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, keyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", PasswordHashArgon2id, h.version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(h.salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// passwordHash verifies passwords against a parsed hash.
+type passwordHash interface {
+	verify(password string) bool
+}
+
+func (h argon2Hash) verify(password string) bool {
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+func parsePasswordHash(s string) (passwordHash, error) {
+	if strings.HasPrefix(s, "$"+PasswordHashArgon2id+"$") {
+		return parseArgon2Hash(s)
+	}
+	if _, err := bcrypt.Cost([]byte(s)); err != nil {
+		return nil, fmt.Errorf("unsupported password hash")
+	}
+	return bcryptHash(s), nil
+}
+
+// dummyHash returns a hash with the same algorithm and cost as the hash, which
+// is verified for unknown users so they take as long as known ones.
+func dummyHash(h passwordHash) passwordHash {
+	salt := make([]byte, argon2SaltLen)
+	rand.Read(salt)
+
+	if h, ok := h.(bcryptHash); ok {
+		cost, _ := bcrypt.Cost(h)
+		hash, err := bcrypt.GenerateFromPassword(salt, cost)
+		if err == nil {
+			return bcryptHash(hash)
+		}
+	}
+	a, ok := h.(argon2Hash)
+	if !ok {
+		a = argon2Hash{argon2.Version, argon2Memory, argon2Time, argon2Threads, nil, make([]byte, argon2KeyLen)}
+	}
+	dummy := a
+	dummy.salt = salt
+	dummy.key = argon2.IDKey(salt, salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+	return dummy
+}
+
+// parsePasswordFile parses the user:hash lines of a password file. Empty lines
+// and lines starting with # are skipped.
+func parsePasswordFile(data []byte) (map[string]passwordHash, passwordHash, error) {
+	users := make(map[string]passwordHash)
+	var first passwordHash
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("line %d: expected user:hash", line)
+		}
+		hash, err := parsePasswordHash(text[i+1:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		users[text[:i]] = hash
+		if first == nil {
+			first = hash
+		}
+	}
+	return users, first, scanner.Err()
+}
+
+// passwordFile authenticates passwords with the hashes of a password file,
+// which is parsed again when it changes on disk.
+type passwordFile struct {
+	file        string
+	handleEvent func(Event)
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]passwordHash
+	dummy   passwordHash
+	err     error
+}
+
+func newPasswordFile(file string, handleEvent func(Event)) *passwordFile {
+	return &passwordFile{
+		file:        file,
+		handleEvent: handleEvent,
+		dummy:       dummyHash(nil),
+	}
+}
+
+// passwordCallback accepts the password if it matches the hash of the user.
+// Unknown users are verified against a dummy hash so they cannot be told
+// apart by timing.
+func (p *passwordFile) passwordCallback(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	users, dummy := p.load()
+	hash, ok := users[meta.User()]
+	if !ok {
+		dummy.verify(string(password))
+		return nil, errInvalidPassword
+	}
+	if !hash.verify(string(password)) {
+		return nil, errInvalidPassword
+	}
+	return &ssh.Permissions{}, nil
+}
+
+// load returns the users of the file, parsing it again if it changed. If the
+// file cannot be read or parsed no user is accepted, and a
+// PasswordFileFailedEvent is emitted when the error changes.
+func (p *passwordFile) load() (map[string]passwordHash, passwordHash) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fi, err := os.Stat(p.file)
+	if err == nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return p.users, p.dummy
+	}
+
+	var users map[string]passwordHash
+	var first passwordHash
+	if err == nil {
+		p.modTime, p.size = fi.ModTime(), fi.Size()
+		var data []byte
+		if data, err = ioutil.ReadFile(p.file); err == nil {
+			users, first, err = parsePasswordFile(data)
+		}
+	}
+	if err != nil {
+		if p.handleEvent != nil && (p.err == nil || p.err.Error() != err.Error()) {
+			p.handleEvent(&PasswordFileFailedEvent{File: p.file, Error: err})
+		}
+		if fi == nil {
+			p.modTime, p.size = time.Time{}, 0
+		}
+		p.users, p.err = nil, err
+		return nil, p.dummy
+	}
+
+	p.users, p.err = users, nil
+	if first != nil {
+		p.dummy = dummyHash(first)
+	}
+	return p.users, p.dummy
+}
+
+// SetPassword adds the user with the password hash to the password file, or
+// replaces the hash if the user exists. The file is created if it does not
+// exist and is replaced atomically. Concurrent changes are serialized with a
+// lock on file.lock, which is left in place; editing the file by other means
+// at the same time may lose either change.
+func SetPassword(file, user, hash string) error {
+	if user == "" || strings.ContainsAny(user, ":\r\n") || strings.HasPrefix(user, "#") {
+		return fmt.Errorf("invalid user %q", user)
+	}
+	if _, err := parsePasswordHash(hash); err != nil {
+		return err
+	}
+	return rewritePasswordFile(file, user, user+":"+hash)
+}
+
+// DeletePassword removes the user from the password file.
+func DeletePassword(file, user string) error {
+	return rewritePasswordFile(file, user, "")
+}
+
+// rewritePasswordFile replaces the line of the user, appending it if the user
+// has no line yet. An empty line removes the user. The replaced file keeps the
+// mode and owner of the existing file, so the server can still read it.
+func rewritePasswordFile(file, user, entry string) error {
+	lock, err := lockPasswordFile(file)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := os.Stat(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	found := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), user+":") {
+			found = true
+			if entry == "" {
+				continue
+			}
+			line = entry + "\n"
+		} else if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		buf.WriteString(line)
+	}
+	if !found {
+		if entry == "" {
+			return fmt.Errorf("user %q not found", user)
+		}
+		buf.WriteString(entry + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if fi != nil {
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := chownLike(tmp, fi); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// lockPasswordFile takes an exclusive lock on a file next to the password
+// file, which is released when the returned file is closed. The password file
+// itself is replaced on every change, so it cannot hold the lock.
+func lockPasswordFile(file string) (*os.File, error) {
+	lock, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// chownLike gives the file the owner and group of fi. Changing them requires
+// privileges, so it is only attempted when they differ.
+func chownLike(f *os.File, fi os.FileInfo) error {
+	want, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	current, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+	return f.Chown(int(want.Uid), int(want.Gid))
+}
@@ -0,0 +1,239 @@
+package shelob
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []string{PasswordHashArgon2id, PasswordHashBcrypt} {
+		hash, err := HashPassword(algorithm, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := parsePasswordHash(hash)
+		if err != nil {
+			t.Fatalf("%s: %s", algorithm, err)
+		}
+		if !h.verify("secret") || h.verify("wrong") {
+			t.Errorf("%s: unexpected verification", algorithm)
+		}
+		if d := dummyHash(h); d.verify("secret") {
+			t.Errorf("%s: expected the dummy hash not to verify", algorithm)
+		}
+	}
+	if _, err := HashPassword("md5", "secret"); err == nil {
+		t.Error("expected an unsupported algorithm to fail")
+	}
+
+	// Reference hash from the argon2 command line tool
+	h, err := parsePasswordHash("$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.verify("password") {
+		t.Error("expected the reference hash to verify")
+	}
+
+	for _, invalid := range []string{"plain", "$argon2id$v=16$m=1,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1,t=0,p=1$c2FsdA$a2V5", "$1$md5$hash",
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1,t=1000,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1,t=1,p=255$c2FsdA$a2V5"} {
+		if _, err := parsePasswordHash(invalid); err == nil {
+			t.Errorf("expected %q to fail", invalid)
+		}
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passwords")
+
+	argonHash, _ := HashPassword(PasswordHashArgon2id, "alice-secret")
+	bcryptHash, _ := HashPassword(PasswordHashBcrypt, "bob-secret")
+	if err := SetPassword(file, "alice", argonHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPassword(file, "bob", bcryptHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPassword(file, "bad:user", argonHash); err == nil {
+		t.Error("expected a user with a colon to fail")
+	}
+	if err := SetPassword(file, "carol", "plain"); err == nil {
+		t.Error("expected an invalid hash to fail")
+	}
+
+	failures := make(chan *PasswordFileFailedEvent, 1)
+	p := newPasswordFile(file, func(evt Event) {
+		failures <- evt.(*PasswordFileFailedEvent)
+	})
+	auth := func(user, password string) bool {
+		_, err := p.passwordCallback(testConnMetadata{user: user}, []byte(password))
+		return err == nil
+	}
+	if !auth("alice", "alice-secret") || !auth("bob", "bob-secret") {
+		t.Fatal("expected the passwords to be accepted")
+	}
+	if auth("alice", "bob-secret") || auth("carol", "alice-secret") {
+		t.Fatal("expected wrong passwords and unknown users to be refused")
+	}
+
+	// Rotated passwords are used once the file changes
+	rotated, _ := HashPassword(PasswordHashArgon2id, "alice-rotated")
+	if err := SetPassword(file, "alice", rotated); err != nil {
+		t.Fatal(err)
+	}
+	if auth("alice", "alice-secret") || !auth("alice", "alice-rotated") {
+		t.Fatal("expected the rotated password")
+	}
+	if err := DeletePassword(file, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if auth("bob", "bob-secret") {
+		t.Fatal("expected the deleted user to be refused")
+	}
+	if err := DeletePassword(file, "bob"); err == nil {
+		t.Error("expected deleting an unknown user to fail")
+	}
+	data, _ := ioutil.ReadFile(file)
+	if strings.Count(string(data), "\n") != 1 || !strings.HasPrefix(string(data), "alice:") {
+		t.Errorf("unexpected file %q", data)
+	}
+
+	// Rewriting the file keeps its mode
+	if err := os.Chmod(file, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPassword(file, "bob", bcryptHash); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("expected mode 0640 to be kept, got %v %v", fi.Mode(), err)
+	}
+	if err := DeletePassword(file, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Root rewriting the file of another user keeps its owner
+	if os.Geteuid() == 0 {
+		if err := os.Chown(file, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetPassword(file, "alice", rotated); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := os.Stat(file)
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != 65534 || st.Gid != 65534 {
+			t.Errorf("expected the owner to be kept, got %d:%d", st.Uid, st.Gid)
+		}
+	}
+
+	// An invalid file refuses every user
+	if err := ioutil.WriteFile(file, append(data, "invalid\n"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if auth("alice", "alice-rotated") {
+		t.Fatal("expected the invalid file to refuse every user")
+	}
+	select {
+	case e := <-failures:
+		if e.File != file {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a PasswordFileFailedEvent")
+	}
+}
+
+func TestSetPasswordConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passwords")
+	hash, _ := HashPassword(PasswordHashBcrypt, "secret")
+
+	// Concurrent changes are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := SetPassword(file, fmt.Sprintf("user%d", i), hash); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _, err := parsePasswordFile(data)
+	if err != nil || len(users) != 16 {
+		t.Fatalf("expected 16 users, got %d %v", len(users), err)
+	}
+}
+
+func TestPasswordFileListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelob-passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passwords")
+	hash, _ := HashPassword(PasswordHashBcrypt, "alice-secret")
+	if err := SetPassword(file, "alice", hash); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := startTestServer(t, &Config{
+		ServerConfig: &ssh.ServerConfig{},
+		PasswordFile: file,
+		Listeners: []ListenerConfig{{
+			Name:         "admin",
+			Listener:     admin,
+			ServerConfig: &ssh.ServerConfig{},
+			PrivateKey:   newTestSigner(t),
+		}},
+	})
+	defer srv.Stop()
+
+	// A listener with its own ServerConfig uses the password file too
+	dial := func(password string) error {
+		client, err := ssh.Dial("tcp", admin.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	if err := dial("alice-secret"); err != nil {
+		t.Fatalf("expected the password file to authenticate, got %v", err)
+	}
+	if err := dial("wrong"); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+}
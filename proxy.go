@@ -0,0 +1,198 @@
+package shelob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature is the 12 byte preamble of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the maximum length of a PROXY protocol v1 header including the CRLF.
+const proxyV1MaxLength = 107
+
+// ErrNoProxyHeader is returned when a trusted upstream does not send a PROXY protocol header.
+var ErrNoProxyHeader = fmt.Errorf("proxy protocol: header missing")
+
+// proxyConn is a connection whose addresses were read from a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// isTrustedProxy returns true if the address is in one of the trusted networks.
+func isTrustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from the connection
+// and returns a connection reporting the addresses passed through by the
+// proxy. Connections from untrusted addresses are returned unchanged.
+func readProxyHeader(conn net.Conn, trusted []*net.IPNet, timeout time.Duration) (net.Conn, error) {
+	if !isTrustedProxy(conn.RemoteAddr(), trusted) {
+		return conn, nil
+	}
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	pc := &proxyConn{
+		Conn:       conn,
+		r:          bufio.NewReader(conn),
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+	}
+
+	// Every valid header is at least as long as the v2 signature
+	prefix, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		err = pc.readV2()
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		err = pc.readV1()
+	default:
+		err = ErrNoProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 parses the human readable header, eg. "PROXY TCP4 1.2.3.4 5.6.7.8 1234 22\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("proxy protocol: invalid v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("proxy protocol: invalid v1 header")
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return fmt.Errorf("proxy protocol: invalid v1 address")
+	}
+
+	// The addresses must be of the family, so TCP4 cannot carry an IPv6 address
+	for _, ip := range fields[2:4] {
+		if strings.Contains(ip, ":") != (fields[1] == "TCP6") {
+			return fmt.Errorf("proxy protocol: v1 address %s is not %s", ip, fields[1])
+		}
+	}
+
+	c.remoteAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.localAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 parses the binary header.
+func (c *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0F
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if version != 2 {
+		return fmt.Errorf("proxy protocol: unsupported version %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	// LOCAL connections, eg. health checks, keep the real addresses.
+	if command == 0x0 {
+		return nil
+	} else if command != 0x1 {
+		return fmt.Errorf("proxy protocol: unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return fmt.Errorf("proxy protocol: invalid v2 address")
+		}
+		c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		c.localAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return fmt.Errorf("proxy protocol: invalid v2 address")
+		}
+		c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		c.localAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		// Unsupported address families keep the real addresses.
+	}
+	return nil
+}
+
+// ParseCIDRs parses a list of CIDR strings, such as "10.0.0.0/8".
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,202 @@
+package shelob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// addrConn overrides the remote address of a connection.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func proxiedPipe(t *testing.T, header []byte) (net.Conn, error) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go client.Write(append(header, "SSH-2.0-test\r\n"...))
+
+	trusted, _ := ParseCIDRs("10.0.0.0/8")
+	conn := addrConn{server, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}}
+	return readProxyHeader(conn, trusted, 0)
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	conn, err := proxiedPipe(t, []byte("PROXY TCP4 192.168.1.10 10.0.0.1 56324 22\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.168.1.10:56324" {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+	if conn.LocalAddr().String() != "10.0.0.1:22" {
+		t.Fatalf("unexpected local addr %s", conn.LocalAddr())
+	}
+
+	// The data after the header is still readable
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Fatalf("unexpected data %q err=%v", buf, err)
+	}
+}
+
+func TestProxyHeaderV1Family(t *testing.T) {
+	for _, header := range []string{
+		"PROXY TCP4 ::1 10.0.0.1 56324 22\r\n",
+		"PROXY TCP4 192.168.1.10 ::ffff:10.0.0.1 56324 22\r\n",
+		"PROXY TCP6 192.168.1.10 2001:db8::2 56324 22\r\n",
+	} {
+		if _, err := proxiedPipe(t, []byte(header)); err == nil {
+			t.Errorf("%q: expected the address family mismatch to fail", header)
+		}
+	}
+
+	conn, err := proxiedPipe(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "[2001:db8::1]:56324" {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	header := bytes.NewBuffer(append([]byte(nil), proxyV2Signature...))
+	header.Write([]byte{0x21, 0x21})
+	binary.Write(header, binary.BigEndian, uint16(36))
+	header.Write(net.ParseIP("2001:db8::1").To16())
+	header.Write(net.ParseIP("2001:db8::2").To16())
+	binary.Write(header, binary.BigEndian, uint16(40000))
+	binary.Write(header, binary.BigEndian, uint16(22))
+
+	conn, err := proxiedPipe(t, header.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "[2001:db8::1]:40000" {
+		t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+	}
+}
+
+func TestProxyHeaderMissing(t *testing.T) {
+	if _, err := proxiedPipe(t, nil); err != ErrNoProxyHeader {
+		t.Fatalf("expected ErrNoProxyHeader, got %v", err)
+	}
+}
+
+func TestProxyHeaderUntrusted(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	trusted, _ := ParseCIDRs("10.0.0.0/8")
+	conn := addrConn{server, &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5000}}
+	proxied, err := readProxyHeader(conn, trusted, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxied != net.Conn(conn) {
+		t.Fatal("expected untrusted connection to be returned unchanged")
+	}
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	trusted, _ := ParseCIDRs("127.0.0.0/8")
+	srv, addr := startTestServer(t, &Config{
+		TrustedProxies: trusted,
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				s.WriteString(s.RemoteAddr().String())
+				return 0
+			}, false, false),
+		},
+	})
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 41000 22\r\n"))
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.Output("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "203.0.113.7:41000" {
+		t.Fatalf("unexpected remote addr %q", out)
+	}
+}
+
+func TestStopClosesPendingProxyConnections(t *testing.T) {
+	trusted, _ := ParseCIDRs("127.0.0.0/8")
+	srv, addr := startTestServer(t, &Config{
+		TrustedProxies:     trusted,
+		ProxyHeaderTimeout: time.Minute,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the connection to be waiting for its header
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.connsMu.Lock()
+		pending := len(srv.pending)
+		srv.connsMu.Unlock()
+		if pending == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pending connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked on a connection waiting for its PROXY header")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the pending connection to be closed, got %v", err)
+	}
+}
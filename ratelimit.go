@@ -0,0 +1,195 @@
+package shelob
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Names of the connection rate limits reported in ConnectionRateLimitedEvent.
+const (
+	RateLimitIP     = "ip"
+	RateLimitSubnet = "subnet"
+)
+
+// RateLimit is a token bucket. Rate tokens are added per second up to Burst,
+// and every connection attempt takes one token. A zero Rate disables the limit.
+// A zero Burst defaults to Rate rounded up, and to at least 1.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig limits the rate of connection attempts per IP address and per
+// network. Attempts are counted before the connection limits are applied.
+type RateLimitConfig struct {
+
+	// IP limits the connection attempts from a single address.
+	IP RateLimit
+
+	// Subnet limits the connection attempts from a network, which is sized
+	// by IPv4PrefixLen and IPv6PrefixLen.
+	Subnet RateLimit
+
+	// IPv4PrefixLen is the prefix length of IPv4 networks, at most 32.
+	// Defaults to 24.
+	IPv4PrefixLen int
+
+	// IPv6PrefixLen is the prefix length of IPv6 networks, at most 128.
+	// Defaults to 64.
+	IPv6PrefixLen int
+}
+
+// validate checks the prefix lengths, as an invalid mask would put every
+// client in the same network.
+func (c RateLimitConfig) validate() error {
+	if c.IPv4PrefixLen < 0 || c.IPv4PrefixLen > 32 {
+		return fmt.Errorf("invalid rate limit IPv4PrefixLen %d", c.IPv4PrefixLen)
+	}
+	if c.IPv6PrefixLen < 0 || c.IPv6PrefixLen > 128 {
+		return fmt.Errorf("invalid rate limit IPv6PrefixLen %d", c.IPv6PrefixLen)
+	}
+	return nil
+}
+
+// rateLimitSweepInterval is how often full buckets are released.
+const rateLimitSweepInterval = time.Minute
+
+// withDefaultBurst sets a zero Burst to the Rate rounded up, and at least 1,
+// since a bucket which holds no token never allows a connection.
+func (limit RateLimit) withDefaultBurst() RateLimit {
+	if limit.Rate > 0 && limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return limit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last update.
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.last = now
+}
+
+// rateLimiter tracks a token bucket per IP address and per network. Buckets
+// which have refilled completely are equivalent to new ones, so they are
+// released periodically to keep the state from growing without bound.
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	ips       map[string]*bucket
+	subnets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.IPv4PrefixLen == 0 {
+		config.IPv4PrefixLen = 24
+	}
+	if config.IPv6PrefixLen == 0 {
+		config.IPv6PrefixLen = 64
+	}
+	config.IP = config.IP.withDefaultBurst()
+	config.Subnet = config.Subnet.withDefaultBurst()
+	return &rateLimiter{
+		config:    config,
+		ips:       make(map[string]*bucket),
+		subnets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// subnet returns the network the IP belongs to.
+func (r *rateLimiter) subnet(ip net.IP) string {
+	mask := net.CIDRMask(r.config.IPv6PrefixLen, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(r.config.IPv4PrefixLen, 32)
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// allow takes a token from the IP and subnet buckets. If either bucket is
+// empty no token is taken and the name of the limit which was hit is returned.
+func (r *rateLimiter) allow(ip net.IP, now time.Time) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+
+	ipBucket := r.bucket(r.ips, ip.String(), r.config.IP, now)
+	subnetBucket := r.bucket(r.subnets, r.subnet(ip), r.config.Subnet, now)
+
+	if ipBucket != nil && ipBucket.tokens < 1 {
+		return RateLimitIP, false
+	}
+	if subnetBucket != nil && subnetBucket.tokens < 1 {
+		return RateLimitSubnet, false
+	}
+
+	if ipBucket != nil {
+		ipBucket.tokens--
+	}
+	if subnetBucket != nil {
+		subnetBucket.tokens--
+	}
+	return "", true
+}
+
+// bucket returns the refilled bucket for the key, or nil if the limit is disabled.
+func (r *rateLimiter) bucket(buckets map[string]*bucket, key string, limit RateLimit, now time.Time) *bucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		buckets[key] = b
+	}
+	b.refill(limit, now)
+	return b
+}
+
+// sweep releases the buckets which have refilled completely.
+func (r *rateLimiter) sweep(now time.Time) {
+	for key, b := range r.ips {
+		if b.refill(r.config.IP, now); b.tokens >= float64(r.config.IP.Burst) {
+			delete(r.ips, key)
+		}
+	}
+	for key, b := range r.subnets {
+		if b.refill(r.config.Subnet, now); b.tokens >= float64(r.config.Subnet.Burst) {
+			delete(r.subnets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// size returns the number of tracked buckets.
+func (r *rateLimiter) size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ips) + len(r.subnets)
+}
+
+// addrIP returns the IP of TCP and UDP addresses, or nil for other address types.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
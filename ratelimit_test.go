@@ -0,0 +1,133 @@
+package shelob
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(RateLimitConfig{
+		IP:     RateLimit{Rate: 1, Burst: 2},
+		Subnet: RateLimit{Rate: 1, Burst: 3},
+	})
+	now := time.Now()
+
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	for i := 0; i < 2; i++ {
+		if _, ok := r.allow(a, now); !ok {
+			t.Fatalf("attempt %d: expected burst to be allowed", i)
+		}
+	}
+	if limit, ok := r.allow(a, now); ok || limit != RateLimitIP {
+		t.Fatalf("expected ip limit, got %q", limit)
+	}
+
+	// Other addresses in the /24 share the subnet bucket
+	if _, ok := r.allow(b, now); !ok {
+		t.Fatal("expected attempt to be allowed")
+	}
+	if limit, ok := r.allow(b, now); ok || limit != RateLimitSubnet {
+		t.Fatalf("expected subnet limit, got %q", limit)
+	}
+	if _, ok := r.allow(net.ParseIP("10.0.1.1"), now); !ok {
+		t.Fatal("expected attempt from another subnet to be allowed")
+	}
+
+	// Tokens are refilled over time
+	if _, ok := r.allow(b, now.Add(time.Second)); !ok {
+		t.Fatal("expected attempt to be allowed after refill")
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	r := newRateLimiter(RateLimitConfig{
+		IP:     RateLimit{Rate: 2.5},
+		Subnet: RateLimit{Rate: 0.5},
+	})
+	if r.config.IP.Burst != 3 || r.config.Subnet.Burst != 1 {
+		t.Fatalf("unexpected bursts %d %d", r.config.IP.Burst, r.config.Subnet.Burst)
+	}
+
+	// A zero Burst still allows attempts at the rate
+	r = newRateLimiter(RateLimitConfig{IP: RateLimit{Rate: 10}})
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if _, ok := r.allow(ip, now.Add(time.Duration(i)*time.Second)); ok {
+			allowed++
+		}
+	}
+	if allowed != 100 {
+		t.Fatalf("expected 100 attempts spaced 1s apart to be allowed, got %d", allowed)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	r := newRateLimiter(RateLimitConfig{
+		IP:     RateLimit{Rate: 1, Burst: 1},
+		Subnet: RateLimit{Rate: 1, Burst: 1},
+	})
+	now := time.Now()
+	r.allow(net.ParseIP("10.0.0.1"), now)
+	r.allow(net.ParseIP("2001:db8::1"), now)
+	if n := r.size(); n != 4 {
+		t.Fatalf("expected 4 buckets, got %d", n)
+	}
+
+	// Full buckets are released once the clients go away
+	r.allow(net.ParseIP("192.168.0.1"), now.Add(rateLimitSweepInterval))
+	if n := r.size(); n != 2 {
+		t.Fatalf("expected 2 buckets after sweep, got %d", n)
+	}
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	events := make(chan *ConnectionRateLimitedEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		RateLimit: &RateLimitConfig{IP: RateLimit{Rate: 0.001, Burst: 1}},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ConnectionRateLimitedEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case e := <-events:
+		if e.Limit != RateLimitIP {
+			t.Fatalf("unexpected limit %q", e.Limit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ConnectionRateLimitedEvent")
+	}
+}
+
+func TestRateLimitPrefixLen(t *testing.T) {
+	for _, conf := range []RateLimitConfig{{IPv4PrefixLen: 33}, {IPv4PrefixLen: -1}, {IPv6PrefixLen: 129}} {
+		_, err := New(context.Background(), &Config{
+			ServerConfig: &ssh.ServerConfig{NoClientAuth: true},
+			RateLimit:    &conf,
+		})
+		if err == nil {
+			t.Errorf("expected %+v to be refused", conf)
+		}
+	}
+	if err := (RateLimitConfig{IPv4PrefixLen: 32, IPv6PrefixLen: 128}).validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,267 @@
+package shelob
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// ConnectionInfo describes an open connection.
+type ConnectionInfo struct {
+	ID         string
+	Listener   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Started    time.Time
+
+	// User and AuthMethod are empty until the client has authenticated. When
+	// an AuthPolicy required several methods, AuthMethod is the completed
+	// chain separated by commas, eg. "publickey,keyboard-interactive".
+	User       string
+	AuthMethod string
+
+	// Channels are the open channels which are being handled.
+	Channels []ChannelInfo
+
+	// BytesReceived and BytesSent count the bytes of the SSH protocol,
+	// including the handshake.
+	BytesReceived uint64
+	BytesSent     uint64
+}
+
+// ChannelInfo describes an open channel of a connection.
+type ChannelInfo struct {
+	ID      uint64
+	Type    string
+	Started time.Time
+}
+
+// connInfo is the accounting and registry information of an open connection.
+type connInfo struct {
+
+	// Byte counters, updated atomically.
+	received uint64
+	sent     uint64
+
+	id       string
+	listener *listener
+	key      string
+	conn     net.Conn
+	started  time.Time
+
+	mu          sync.Mutex
+	user        string
+	authMethod  string
+	state       *connState
+	channels    map[uint64]ChannelInfo
+	nextChannel uint64
+}
+
+func newConnInfo(id string, l *listener, key string, conn net.Conn) *connInfo {
+	return &connInfo{
+		id:       id,
+		listener: l,
+		key:      key,
+		conn:     conn,
+		started:  time.Now(),
+		channels: make(map[uint64]ChannelInfo),
+	}
+}
+
+// info returns a snapshot of the connection.
+func (c *connInfo) info() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channels := make([]ChannelInfo, 0, len(c.channels))
+	for _, ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+
+	return ConnectionInfo{
+		ID:            c.id,
+		Listener:      c.listener.name,
+		LocalAddr:     c.conn.LocalAddr(),
+		RemoteAddr:    c.conn.RemoteAddr(),
+		Started:       c.started,
+		User:          c.user,
+		AuthMethod:    c.authMethod,
+		Channels:      channels,
+		BytesReceived: atomic.LoadUint64(&c.received),
+		BytesSent:     atomic.LoadUint64(&c.sent),
+	}
+}
+
+// authenticated records the user, the chain of methods required by an
+// AuthPolicy and the connection state once the handshake succeeded.
+func (c *connInfo) authenticated(user string, perms *ssh.Permissions, state *connState) {
+	c.mu.Lock()
+	c.user = user
+	if perms != nil {
+		if methods, ok := perms.Extensions[permAuthMethods]; ok {
+			c.authMethod = methods
+		}
+	}
+	c.state = state
+	c.mu.Unlock()
+}
+
+// authLogCallback wraps the AuthLogCallback of the ssh config to record the
+// method the client authenticated with and to report failed attempts. Partial
+// successes of an AuthPolicy chain are not failures.
+func (s *Server) authLogCallback(info *connInfo, cb func(ssh.ConnMetadata, string, error)) func(ssh.ConnMetadata, string, error) {
+	return func(meta ssh.ConnMetadata, method string, err error) {
+		_, partial := err.(*ssh.PartialSuccessError)
+		if err == nil {
+			info.mu.Lock()
+			info.authMethod = method
+			info.mu.Unlock()
+		} else if method != "none" && !partial {
+			s.handleEvent(&AuthFailedEvent{
+				ConnectionID: info.id,
+				Listener:     info.listener.name,
+				User:         meta.User(),
+				Method:       method,
+				Error:        err,
+			})
+		}
+		if cb != nil {
+			cb(meta, method, err)
+		}
+	}
+}
+
+// addChannel registers a channel and returns its ID.
+func (c *connInfo) addChannel(chType string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextChannel++
+	c.channels[c.nextChannel] = ChannelInfo{ID: c.nextChannel, Type: chType, Started: time.Now()}
+	return c.nextChannel
+}
+
+func (c *connInfo) removeChannel(id uint64) {
+	c.mu.Lock()
+	delete(c.channels, id)
+	c.mu.Unlock()
+}
+
+// countingConn counts the bytes read from and written to the connection.
+type countingConn struct {
+	net.Conn
+	info *connInfo
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.info.received, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.info.sent, uint64(n))
+	return n, err
+}
+
+// ConnectionID returns the ID of the connection the context belongs to. The ID
+// matches the ConnectionID of events and ConnectionInfo.
+func ConnectionID(ctx context.Context) (string, bool) {
+	state, ok := connStateFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return state.id, true
+}
+
+// register adds the connection to the registry. Guarded by connsMu.
+func (s *Server) register(l *listener, key string, conn net.Conn) *connInfo {
+	s.nextConnID++
+	info := newConnInfo(strconv.FormatUint(s.nextConnID, 10), l, key, conn)
+	s.conns[conn] = info
+	return info
+}
+
+// Connections returns the open connections ordered by the time they were accepted.
+func (s *Server) Connections() []ConnectionInfo {
+	s.connsMu.Lock()
+	infos := make([]*connInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		infos = append(infos, info)
+	}
+	s.connsMu.Unlock()
+
+	conns := make([]ConnectionInfo, 0, len(infos))
+	for _, info := range infos {
+		conns = append(conns, info.info())
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Started.Before(conns[j].Started) })
+	return conns
+}
+
+// Disconnect closes the connection with the ID. The reason is written to the
+// stderr of its open sessions first, if not empty, waiting at most a second
+// for a client which is not reading.
+func (s *Server) Disconnect(id, reason string) error {
+	s.connsMu.Lock()
+	var found *connInfo
+	for _, info := range s.conns {
+		if info.id == id {
+			found = info
+			break
+		}
+	}
+	s.connsMu.Unlock()
+
+	if found == nil {
+		return fmt.Errorf("connection %s not found", id)
+	}
+	s.disconnect(found, reason)
+	return nil
+}
+
+// DisconnectUser closes all the connections of the user and returns how many
+// were closed. The reason is written to the stderr of their open sessions first,
+// if not empty, waiting at most a second for clients which are not reading.
+func (s *Server) DisconnectUser(user, reason string) int {
+	s.connsMu.Lock()
+	var found []*connInfo
+	for _, info := range s.conns {
+		info.mu.Lock()
+		if info.state != nil && info.user == user {
+			found = append(found, info)
+		}
+		info.mu.Unlock()
+	}
+	s.connsMu.Unlock()
+
+	for _, info := range found {
+		s.disconnect(info, reason)
+	}
+	return len(found)
+}
+
+func (s *Server) disconnect(info *connInfo, reason string) {
+	info.mu.Lock()
+	user, state := info.user, info.state
+	info.mu.Unlock()
+
+	if state != nil && reason != "" {
+		state.notifySessions(reason)
+	}
+	info.conn.Close()
+	s.handleEvent(&ConnectionDisconnectedEvent{
+		ConnectionID: info.id,
+		Listener:     info.listener.name,
+		User:         user,
+		Reason:       reason,
+	})
+}
@@ -0,0 +1,142 @@
+package shelob
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestConnectionRegistry(t *testing.T) {
+	ids := make(chan string, 1)
+	events := make(chan *ConnectionDisconnectedEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		ServerConfig: &ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				id, _ := ConnectionID(ctx)
+				ids <- id
+				<-ctx.Done()
+				return 0
+			}, false, false),
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ConnectionDisconnectedEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	id := <-ids
+
+	conns := srv.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+	c := conns[0]
+	if c.ID != id || c.User != "alice" || c.AuthMethod != "password" || c.Listener != DefaultListenerName {
+		t.Fatalf("unexpected connection %+v", c)
+	}
+	if len(c.Channels) != 1 || c.Channels[0].Type != "session" {
+		t.Fatalf("unexpected channels %+v", c.Channels)
+	}
+	if c.BytesReceived == 0 || c.BytesSent == 0 {
+		t.Fatalf("expected byte counters, got %+v", c)
+	}
+
+	if err := srv.Disconnect("unknown", ""); err == nil {
+		t.Fatal("expected error disconnecting an unknown connection")
+	}
+	if n := srv.DisconnectUser("alice", "Maintenance\r\n"); n != 1 {
+		t.Fatalf("expected 1 connection to be disconnected, got %d", n)
+	}
+	if e := <-events; e.ConnectionID != id || e.User != "alice" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	sess.Wait()
+	if stderr.String() != "Maintenance\r\n" {
+		t.Fatalf("unexpected disconnect reason %q", stderr.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be removed from the registry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDisconnectStalledClient(t *testing.T) {
+	writing := make(chan string, 1)
+	srv, addr := startTestServer(t, &Config{
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				id, _ := ConnectionID(ctx)
+				writing <- id
+
+				// Fill the window of a client which never reads
+				s.Write(make([]byte, 8<<20))
+				return 0
+			}, false, false),
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.StdoutPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.StderrPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	id := <-writing
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Disconnect(id, "Maintenance\r\n")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected Disconnect to give up on a client which is not reading")
+	}
+	client.Wait()
+}
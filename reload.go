@@ -0,0 +1,160 @@
+package shelob
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/net/context"
+)
+
+// SignalAction is the action taken when the server receives a signal on Config.SignalChan.
+type SignalAction int
+
+const (
+	// SignalStop stops the server immediately. This is the default action.
+	SignalStop SignalAction = iota
+
+	// SignalDrain gracefully shuts down the server, waiting up to Config.DrainTimeout.
+	SignalDrain
+
+	// SignalReload reloads the config with Config.ReloadFunc.
+	SignalReload
+
+	// SignalStats emits a StatsEvent.
+	SignalStats
+
+	// SignalUpgrade hands the listeners to a new process and drains, see Server.Upgrade.
+	SignalUpgrade
+)
+
+func (a SignalAction) String() string {
+	switch a {
+	case SignalStop:
+		return "stop"
+	case SignalDrain:
+		return "drain"
+	case SignalReload:
+		return "reload"
+	case SignalStats:
+		return "stats"
+	case SignalUpgrade:
+		return "upgrade"
+	default:
+		return fmt.Sprintf("SignalAction(%d)", int(a))
+	}
+}
+
+// ReloadFunc returns a freshly loaded config, eg. re-read from disk. Only the
+// host keys, authentication, banners, limits and handlers of the listeners and
+// the access lists are applied. Server wide settings, such as MaxStartups,
+// RateLimit, Bans, PanicPolicy, the EventHandler and the signal, shutdown and
+// upgrade settings, keep the values the server was created with. The returned
+// config and its ServerConfig are not modified, so they may be returned again.
+type ReloadFunc func() (*Config, error)
+
+func (s *Server) handleSignal(sig os.Signal) {
+	action, ok := s.config.SignalActions[sig]
+	if !ok {
+		action = SignalStop
+	}
+	s.handleEvent(&SignalEvent{Signal: sig, Action: action})
+
+	switch action {
+	case SignalReload:
+		s.Reload()
+	case SignalStats:
+		s.handleEvent(&StatsEvent{Stats: s.Stats()})
+	case SignalUpgrade:
+		go s.Upgrade()
+	case SignalDrain:
+		s.drain()
+	default:
+		signal.Stop(s.config.SignalChan)
+		s.cancel()
+	}
+}
+
+// drain stops handling signals and gracefully shuts down the server in the
+// background, waiting up to Config.DrainTimeout.
+func (s *Server) drain() {
+	if s.config.SignalChan != nil {
+		signal.Stop(s.config.SignalChan)
+	}
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		if s.config.DrainTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, s.config.DrainTimeout)
+		}
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+}
+
+// Reload loads a new config with Config.ReloadFunc and applies it to new
+// connections. Existing connections keep the config they were accepted with.
+// Listeners are matched by name; adding or removing listeners requires a
+// restart. If the reload fails the current config is kept and a
+// ReloadFailedEvent is emitted.
+func (s *Server) Reload() error {
+	err := s.reload()
+	if err != nil {
+		s.handleEvent(&ReloadFailedEvent{Error: err})
+		return err
+	}
+	s.handleEvent(&ReloadedEvent{})
+	return nil
+}
+
+func (s *Server) reload() error {
+	if s.config.ReloadFunc == nil {
+		return fmt.Errorf("reload: ReloadFunc must be provided")
+	}
+
+	conf, err := s.config.ReloadFunc()
+	if err != nil {
+		return err
+	} else if conf == nil {
+		return fmt.Errorf("reload: ReloadFunc returned a nil config")
+	}
+
+	// The defaults and wrapped callbacks are set on a copy
+	reloaded := *conf
+	conf = &reloaded
+	listeners, err := newListeners(conf, s.handleEvent)
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]*listenerSettings, len(listeners))
+	for _, l := range listeners {
+		settings[l.name] = l.settings
+	}
+
+	// The default listener may have been added by Serve
+	if _, ok := settings[DefaultListenerName]; !ok {
+		settings[DefaultListenerName] = newListener(conf, ListenerConfig{Name: DefaultListenerName}).settings
+	}
+
+	// Validate before swapping so a failed reload changes nothing
+	running := make(map[string]bool, len(s.listeners))
+	for _, l := range s.listeners {
+		running[l.name] = true
+		if _, ok := settings[l.name]; !ok {
+			return fmt.Errorf("reload: listener %q: removing listeners requires a restart", l.name)
+		}
+	}
+	for _, l := range listeners {
+		if !running[l.name] {
+			return fmt.Errorf("reload: listener %q: adding listeners requires a restart", l.name)
+		}
+	}
+
+	s.connsMu.Lock()
+	for _, l := range s.listeners {
+		l.settings = settings[l.name]
+	}
+	s.connsMu.Unlock()
+
+	s.SetAccessLists(conf.AllowedNetworks, conf.DeniedNetworks)
+	return nil
+}
@@ -0,0 +1,175 @@
+package shelob
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestReload(t *testing.T) {
+	events := make(chan Event, 16)
+	var reloadErr error
+	var conf *Config
+	conf = &Config{
+		ChannelHandlers: writeHandlers("one"),
+		EventHandler: func(evt Event) {
+			switch evt.(type) {
+			case *ReloadedEvent, *ReloadFailedEvent:
+				events <- evt
+			}
+		},
+		ReloadFunc: func() (*Config, error) {
+			if reloadErr != nil {
+				return nil, reloadErr
+			}
+			return &Config{
+				PrivateKey:      conf.PrivateKey,
+				ChannelHandlers: writeHandlers("two"),
+				ServerConfig:    &ssh.ServerConfig{NoClientAuth: true},
+			}, nil
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+	defer srv.Stop()
+
+	before := dialTestServer(t, addr)
+	defer before.Close()
+
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (<-events).(*ReloadedEvent); !ok {
+		t.Fatal("expected ReloadedEvent")
+	}
+
+	// Existing connections keep their config
+	if out := sessionOutput(t, before); out != "one" {
+		t.Fatalf("expected existing connection to use the old config, got %q", out)
+	}
+
+	after := dialTestServer(t, addr)
+	defer after.Close()
+	if out := sessionOutput(t, after); out != "two" {
+		t.Fatalf("expected new connection to use the new config, got %q", out)
+	}
+
+	// A failed reload keeps the current config
+	reloadErr = fmt.Errorf("bad config")
+	if err := srv.Reload(); err != reloadErr {
+		t.Fatalf("expected reload error, got %v", err)
+	}
+	if e, ok := (<-events).(*ReloadFailedEvent); !ok || e.Error != reloadErr {
+		t.Fatal("expected ReloadFailedEvent")
+	}
+
+	failed := dialTestServer(t, addr)
+	defer failed.Close()
+	if out := sessionOutput(t, failed); out != "two" {
+		t.Fatalf("expected config to be kept after a failed reload, got %q", out)
+	}
+}
+
+func TestSignalActions(t *testing.T) {
+	stats := make(chan Stats, 1)
+	sigCh := make(chan os.Signal, 1)
+	conf := &Config{
+		SignalChan: sigCh,
+		SignalActions: map[os.Signal]SignalAction{
+			syscall.SIGUSR1: SignalStats,
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*StatsEvent); ok {
+				stats <- e.Stats
+			}
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	sigCh <- syscall.SIGUSR1
+	select {
+	case s := <-stats:
+		if s.Connections != 1 || len(s.Listeners) != 1 || s.Listeners[0].Clients != 1 {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected StatsEvent")
+	}
+
+	// Unmapped signals stop the server
+	sigCh <- syscall.SIGTERM
+	select {
+	case <-srv.doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected server to stop")
+	}
+}
+
+func TestReloadSameServerConfig(t *testing.T) {
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("invalid password")
+			}
+			return nil, nil
+		},
+	}
+	methods := make(chan []string, 1)
+	var conf *Config
+	conf = &Config{
+		ServerConfig: sshConfig,
+		AuthPolicy: func(user string) AuthPolicy {
+			return AuthPolicy{{AuthMethodPassword}}
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				methods <- s.AuthMethods()
+				return 0
+			}, false, false),
+		},
+		ReloadFunc: func() (*Config, error) {
+			return &Config{
+				PrivateKey:      conf.PrivateKey,
+				ServerConfig:    sshConfig,
+				AuthPolicy:      conf.AuthPolicy,
+				ChannelHandlers: conf.ChannelHandlers,
+			}, nil
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+	defer srv.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := srv.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The callbacks of the returned ServerConfig are never wrapped
+	perms, err := sshConfig.PasswordCallback(testConnMetadata{user: "alice"}, []byte("secret"))
+	if err != nil || perms != nil {
+		t.Fatalf("expected the original callback, got %+v %v", perms, err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sessionOutput(t, client)
+	if m := <-methods; len(m) != 1 || m[0] != AuthMethodPassword {
+		t.Fatalf("unexpected auth methods %v", m)
+	}
+}
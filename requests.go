@@ -9,6 +9,8 @@ type contextKey string
 
 const keySSHConn contextKey = "server-conn"
 const keyEventHandler contextKey = "event-handler"
+const keyDrainNotice contextKey = "drain-notice"
+const keyListenerName contextKey = "listener-name"
 
 // WithServerConn adds a ssh.ServerConn to a context.
 func WithServerConn(ctx context.Context, sshConn *ssh.ServerConn) context.Context {
@@ -21,6 +23,34 @@ func SSHServerConn(ctx context.Context) (*ssh.ServerConn, bool) {
 	return srv, ok
 }
 
+func withListenerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, keyListenerName, name)
+}
+
+// ListenerName returns the name of the listener the connection arrived on.
+func ListenerName(ctx context.Context) string {
+	name, _ := ctx.Value(keyListenerName).(string)
+	return name
+}
+
+type drainNotice struct {
+	ch      <-chan struct{}
+	message string
+}
+
+func withDrainNotice(ctx context.Context, ch <-chan struct{}, message string) context.Context {
+	return context.WithValue(ctx, keyDrainNotice, drainNotice{ch, message})
+}
+
+// Draining returns a channel which is closed when the server begins a graceful
+// shutdown. Handlers can use it to wrap up long running work before the
+// shutdown deadline. A nil channel is returned if the context did not come
+// from a Server.
+func Draining(ctx context.Context) <-chan struct{} {
+	notice, _ := ctx.Value(keyDrainNotice).(drainNotice)
+	return notice.ch
+}
+
 // RequestHandler handles global requests on a connection.
 type RequestHandler interface {
 	HandleRequest(ctx context.Context, req *ssh.Request) (ok bool, payload []byte)
@@ -0,0 +1,154 @@
+package shelob
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestServeUnixListener(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "shelob.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	srv, err := New(context.Background(), &Config{
+		MaxClientConnections: 1,
+		PrivateKey:           signer,
+		ServerConfig:         &ssh.ServerConfig{NoClientAuth: true},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				s.WriteString("hello")
+				return 0
+			}, false, false),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	// Per client limits are skipped for unix sockets, so both clients connect.
+	clients := make([]*ssh.Client, 2)
+	for i := range clients {
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, "", &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = ssh.NewClient(c, chans, reqs)
+		defer clients[i].Close()
+	}
+
+	for _, client := range clients {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := sess.Output("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "hello" {
+			t.Fatalf("unexpected output %q", out)
+		}
+	}
+}
+
+func TestIPClientKey(t *testing.T) {
+	if key := IPClientKey(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}); key != "10.0.0.1" {
+		t.Fatalf("unexpected key %q", key)
+	}
+	if key := IPClientKey(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}); key != "" {
+		t.Fatalf("expected empty key for unix addr, got %q", key)
+	}
+}
+
+func TestStopIsImmediate(t *testing.T) {
+	srv, _ := startTestServer(t, &Config{})
+
+	// Idle longer than the accept backoff of the old polling loop
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	srv.Stop()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("stop took %s", elapsed)
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	handler := func(ctx context.Context, s Session) int {
+		s.WriteString(ListenerName(ctx))
+		return 0
+	}
+	automation, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	opened := make(map[string]bool)
+	conf := &Config{
+		Listeners: []ListenerConfig{{
+			Name:     "automation",
+			Listener: automation,
+			ChannelHandlers: map[string]ChannelHandler{
+				"session": NewSessionChannelHandler(handler, false, false),
+			},
+		}},
+		ChannelHandlers: map[string]ChannelHandler{},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ConnectionOpenedEvent); ok {
+				mu.Lock()
+				opened[e.Listener] = true
+				mu.Unlock()
+			}
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+	defer srv.Stop()
+
+	// The default listener has no session handler
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	if _, err := client.NewSession(); err == nil {
+		t.Fatal("expected session to be rejected on the default listener")
+	}
+
+	client = dialTestServer(t, automation.Addr().String())
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.Output("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "automation" {
+		t.Fatalf("unexpected listener name %q", out)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !opened[DefaultListenerName] || !opened["automation"] {
+		t.Fatalf("expected connections on both listeners, got %v", opened)
+	}
+}
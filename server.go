@@ -1,10 +1,9 @@
 package shelob
 
 import (
-	"fmt"
 	"net"
-	"os/signal"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -21,26 +20,58 @@ func New(ctx context.Context, conf *Config) (*Server, error) {
 		conf.MaxDeadline = time.Second
 	}
 
-	// ServerConfig is required.
-	if conf.ServerConfig == nil {
-		return nil, fmt.Errorf("ssh.ServerConfig must be provided")
+	// Set default proxy header timeout of 5 seconds
+	if conf.ProxyHeaderTimeout == 0 {
+		conf.ProxyHeaderTimeout = 5 * time.Second
 	}
 
-	// Wrap provided public key callback to inject permission extensions
-	// for getting the public key information in the session.
-	if conf.ServerConfig.PublicKeyCallback != nil {
-		conf.ServerConfig.PublicKeyCallback = pubKeyCallbackWrapper(conf.ServerConfig.PublicKeyCallback)
+	// Set default upgrade timeout of 30 seconds
+	if conf.UpgradeTimeout == 0 {
+		conf.UpgradeTimeout = 30 * time.Second
 	}
 
-	// Add private key to ServerConfig
-	if conf.PrivateKey != nil {
-		conf.ServerConfig.AddHostKey(conf.PrivateKey)
+	listeners, err := newListeners(conf, conf.EventHandler)
+	if err != nil {
+		return nil, err
+	}
+	if conf.MaxStartups != nil {
+		if err := conf.MaxStartups.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var limiter *rateLimiter
+	if conf.RateLimit != nil {
+		if err := conf.RateLimit.validate(); err != nil {
+			return nil, err
+		}
+		limiter = newRateLimiter(*conf.RateLimit)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
-	closeCh := make(chan *net.TCPConn, 1)
-	doneCh := make(chan struct{})
-	return &Server{ctx, cancel, closeCh, doneCh, conf, conf.ServerConfig, nil, nil}, nil
+	s := &Server{
+		ctx:       ctx,
+		cancel:    cancel,
+		doneCh:    make(chan struct{}),
+		drainCh:   make(chan struct{}),
+		config:    conf,
+		listeners: listeners,
+		conns:     make(map[net.Conn]*connInfo),
+		pending:   make(map[net.Conn]struct{}),
+		limiter:   limiter,
+		access:    &accessList{conf.AllowedNetworks, conf.DeniedNetworks},
+	}
+
+	var banConfig BanConfig
+	if conf.Bans != nil {
+		banConfig = *conf.Bans
+	}
+	s.bans, err = newBanList(banConfig, s.handleEvent)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
 }
 
 // PublicKeyCallback represents the function type for Public Key auth in crypto/ssh.
@@ -58,8 +89,11 @@ func pubKeyCallbackWrapper(cb PublicKeyCallback) PublicKeyCallback {
 		}
 
 		perm, err = cb(meta, key)
+		if _, partial := err.(*ssh.PartialSuccessError); partial {
+			return perm, err
+		}
 		if err != nil {
-			return nil, err
+			return nil, &keyRefusedError{err}
 		}
 
 		// Ensure perm.Extensions exists
@@ -75,6 +109,7 @@ func pubKeyCallbackWrapper(cb PublicKeyCallback) PublicKeyCallback {
 		perm.Extensions[permKeyType] = key.Type()
 		perm.Extensions[permKeyData] = string(key.Marshal())
 		perm.Extensions[permKeyFingerprint] = ssh.FingerprintLegacyMD5(key)
+		perm.Extensions[permAuthMethod] = AuthMethodPublicKey
 		return perm, nil
 	}
 }
@@ -83,41 +118,94 @@ func pubKeyCallbackWrapper(cb PublicKeyCallback) PublicKeyCallback {
 type Server struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
-	closeCh   chan *net.TCPConn
 	doneCh    chan struct{}
 	config    *Config
-	sshConfig *ssh.ServerConfig
-
-	Addr     *net.TCPAddr
-	listener *net.TCPListener
+	listeners []*listener
+
+	// drainCh is closed when a graceful shutdown begins.
+	drainCh   chan struct{}
+	drainOnce sync.Once
+
+	// conns holds every open connection so they can be force closed once
+	// the shutdown deadline expires, and pending the connections still
+	// waiting for their PROXY protocol header or being told why they were
+	// rejected. The listener connection counters are guarded by the same mutex.
+	connsMu    sync.Mutex
+	conns      map[net.Conn]*connInfo
+	pending    map[net.Conn]struct{}
+	nextConnID uint64
+	startups   int
+	rejecting  int
+	draining   bool
+	wg         sync.WaitGroup
+
+	// limiter applies Config.RateLimit, nil if disabled.
+	limiter *rateLimiter
+
+	// bans holds the banned client addresses.
+	bans *banList
+
+	// access holds the allowed and denied networks.
+	accessMu sync.RWMutex
+	access   *accessList
+
+	// Addr is the address of the default listener.
+	Addr net.Addr
 }
 
-// ListenAndServe starts accepting client connections.
+// ListenAndServe starts accepting client connections. Sockets passed with
+// systemd socket activation (LISTEN_FDS) or by Server.Upgrade are used in place
+// of binding the listener addresses. They are matched to listeners by the names
+// in LISTEN_FDNAMES, then by the address they are bound to. An error is
+// returned if a listener matches none of the sockets which are left.
 func (s *Server) ListenAndServe() error {
 	s.handleEvent(&ServerStartedEvent{})
+	return s.serve()
+}
 
-	// Validate the ssh bind addr
-	if s.config.Addr == "" {
-		s.config.Addr = ":22"
-	}
+// Serve starts accepting client connections on the given listener in place
+// of Config.Addr. Any other configured listeners are opened as well. The
+// listeners are closed when the server stops.
+func (s *Server) Serve(l net.Listener) error {
+	s.handleEvent(&ServerStartedEvent{})
 
-	// Open SSH socket listener
-	sshAddr, e := net.ResolveTCPAddr("tcp", s.config.Addr)
-	if e != nil {
-		return fmt.Errorf("ssh server: Invalid tcp address")
+	if len(s.listeners) == 0 || s.listeners[0].name != DefaultListenerName {
+		s.listeners = append([]*listener{newListener(s.config, ListenerConfig{Name: DefaultListenerName})}, s.listeners...)
 	}
+	s.listeners[0].Listener = l
+	return s.serve()
+}
 
-	// Create listener
-	listener, err := net.ListenTCP("tcp", sshAddr)
-	if err != nil {
+func (s *Server) serve() error {
+
+	// Use the sockets inherited from systemd or an upgrade
+	if err := s.inherit(); err != nil {
 		return err
 	}
-	s.Addr = listener.Addr().(*net.TCPAddr)
-	s.listener = listener
-	s.handleEvent(&ListenerOpenedEvent{s.Addr})
 
-	s.listen()
-	return nil
+	// Open all the listeners before accepting on any of them
+	for _, l := range s.listeners {
+		if err := l.open(); err != nil {
+			for _, l := range s.listeners {
+				if l.Listener != nil {
+					l.Close()
+				}
+			}
+			return err
+		}
+	}
+	if s.listeners[0].name == DefaultListenerName {
+		s.Addr = s.listeners[0].Addr()
+	}
+
+	for _, l := range s.listeners {
+		s.handleEvent(&ListenerOpenedEvent{
+			Listener: l.name,
+			Addr:     l.Addr(),
+		})
+	}
+	notifyReady()
+	return s.listen()
 }
 
 // Stop stops the server and kills all goroutines. This method is blocking.
@@ -126,177 +214,452 @@ func (s *Server) Stop() {
 	<-s.doneCh
 }
 
+// Shutdown gracefully stops the server. The listener is closed so no new
+// connections are accepted, open sessions are sent the configured
+// ShutdownMessage and running handlers are allowed to finish. If the context
+// expires before all the connections have closed, the remaining connections
+// are force closed and the context error is returned. This method is blocking.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		close(s.drainCh)
+	})
+
+	select {
+	case <-s.doneCh:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Deadline expired; kill the remaining connections. The events are
+	// emitted without the lock so handlers may call Connections or Stats.
+	s.connsMu.Lock()
+	remaining := make([]*connInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		remaining = append(remaining, info)
+	}
+	s.connsMu.Unlock()
+
+	for _, info := range remaining {
+		info.conn.Close()
+		s.handleEvent(&ConnectionKilledEvent{
+			ConnectionID: info.id,
+			Listener:     info.listener.name,
+			LocalAddr:    info.conn.LocalAddr(),
+			RemoteAddr:   info.conn.RemoteAddr(),
+		})
+	}
+
+	s.cancel()
+	<-s.doneCh
+	return ctx.Err()
+}
+
 func (s *Server) handleEvent(evt Event) {
 	if s.config.EventHandler != nil {
 		s.config.EventHandler(evt)
 	}
 }
 
-// listen accepts new connections and handles the conversion from TCP to SSH connections.
-func (s *Server) listen() {
+// listen accepts new connections on every listener and handles the conversion
+// from network to SSH connections. Accept blocks until a connection arrives or
+// the listener is closed by the server stopping.
+func (s *Server) listen() error {
 	defer close(s.doneCh)
 
+	acceptDoneCh := make(chan struct{})
+	go s.watch(acceptDoneCh)
+
 	var wg sync.WaitGroup
-	var openConnections int
-	clientConnections := make(map[string]int)
+	errCh := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			errCh <- s.acceptLoop(l)
+		}(l)
+	}
+	wg.Wait()
+	close(acceptDoneCh)
+	close(errCh)
 
-	initialDeadline := 5 * time.Millisecond
-	deadline := initialDeadline
-OUTER:
+	// Wait for all connections to close
+	s.wg.Wait()
+
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acceptLoop accepts connections on a single listener until it is closed.
+func (s *Server) acceptLoop(l *listener) error {
+	var tempDelay time.Duration
 	for {
-		if deadline > s.config.MaxDeadline {
-			deadline = s.config.MaxDeadline
+		conn, err := l.Accept()
+		if err != nil {
+
+			// Listener was closed by Stop or Shutdown
+			if s.ctx.Err() != nil || isClosed(s.drainCh) {
+				return nil
+			}
+
+			// Back off on temporary failures such as running out of file descriptors
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				s.handleEvent(&ConnectionFailedEvent{Listener: l.name, Error: err})
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > s.config.MaxDeadline {
+					tempDelay = s.config.MaxDeadline
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+
+			// Listener failed; stop the server
+			s.handleEvent(&ConnectionFailedEvent{Listener: l.name, Error: err})
+			s.cancel()
+			return err
+		}
+		tempDelay = 0
+
+		// Connections keep the settings they were accepted with
+		s.connsMu.Lock()
+		settings := l.settings
+		s.connsMu.Unlock()
+
+		// Read the PROXY protocol header without blocking the accept loop
+		if len(settings.trustedProxies) > 0 {
+			s.connsMu.Lock()
+			s.pending[conn] = struct{}{}
+			s.connsMu.Unlock()
+			s.wg.Add(1)
+			go s.acceptProxied(l, settings, conn)
+			continue
 		}
+		s.accept(l, settings, conn)
+	}
+}
 
-		// Accepts will only block for deadline
-		s.listener.SetDeadline(time.Now().Add(deadline))
+// acceptProxied reads the PROXY protocol header before accepting the connection.
+func (s *Server) acceptProxied(l *listener, settings *listenerSettings, conn net.Conn) {
+	defer s.wg.Done()
 
+	proxied, err := readProxyHeader(conn, settings.trustedProxies, s.config.ProxyHeaderTimeout)
+	s.connsMu.Lock()
+	delete(s.pending, conn)
+	stopped := s.ctx.Err() != nil || s.draining
+	s.connsMu.Unlock()
+	if err != nil {
+		conn.Close()
+
+		// The server closed the connection while it was stopping
+		if stopped {
+			return
+		}
+		s.handleEvent(&ProxyHeaderFailedEvent{
+			Listener:   l.name,
+			LocalAddr:  conn.LocalAddr(),
+			RemoteAddr: conn.RemoteAddr(),
+			Error:      err,
+		})
+		return
+	}
+	s.accept(l, settings, proxied)
+}
+
+// watch handles signals and closes the listeners as soon as the server is
+// stopped or drained, which unblocks Accept.
+func (s *Server) watch(acceptDoneCh <-chan struct{}) {
+	for {
 		select {
+		case <-acceptDoneCh:
+			return
 
-		// Stop server on channel receive
+		// Run the action mapped to the signal
+		case sig := <-s.config.SignalChan:
+			s.handleSignal(sig)
+			continue
 		case <-s.ctx.Done():
-			s.handleEvent(&ServerStoppedEvent{})
-			s.listener.Close()
-			s.handleEvent(&ListenerClosedEvent{})
-			break OUTER
-		case <-s.config.SignalChan:
-			s.cancel()
 
-			// Stop listening for signals and close channel
-			signal.Stop(s.config.SignalChan)
-			// close(s.config.SignalChan)
-			continue
-		case tcpConn := <-s.closeCh:
-			wg.Done()
-			deadline = initialDeadline
-
-			openConnections--
-			tcpAddr := tcpConn.RemoteAddr().(*net.TCPAddr)
-			if _, ok := clientConnections[tcpAddr.IP.String()]; ok {
-				clientConnections[tcpAddr.IP.String()]--
-			}
+		// Stop accepting and wait for the open connections to finish
+		case <-s.drainCh:
+			s.connsMu.Lock()
+			s.draining = true
+			openConnections := len(s.conns)
+			s.connsMu.Unlock()
+			s.handleEvent(&DrainStartedEvent{Connections: openConnections})
+		}
+		break
+	}
 
-			s.handleEvent(&ConnectionClosedEvent{
-				LocalAddr:  tcpConn.LocalAddr(),
-				RemoteAddr: tcpConn.RemoteAddr(),
+	s.handleEvent(&ServerStoppedEvent{})
+	for _, l := range s.listeners {
+		l.Close()
+		s.handleEvent(&ListenerClosedEvent{Listener: l.name})
+	}
+
+	// Connections still waiting for their PROXY header are never accepted,
+	// rejected clients are not told why any longer, and stopping closes the
+	// open connections so their goroutines exit
+	s.connsMu.Lock()
+	for conn := range s.pending {
+		conn.Close()
+	}
+	if s.ctx.Err() != nil {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+	s.connsMu.Unlock()
+}
+
+// accept applies the listener's connection limits and starts handling the connection.
+func (s *Server) accept(l *listener, settings *listenerSettings, conn net.Conn) {
+
+	// Reject clients from networks which are not permitted
+	if !s.permits(conn.RemoteAddr()) {
+		conn.Close()
+		s.handleEvent(&ConnectionDeniedEvent{
+			Listener:   l.name,
+			LocalAddr:  conn.LocalAddr(),
+			RemoteAddr: conn.RemoteAddr(),
+		})
+		return
+	}
+
+	// Reject banned clients
+	if ip := addrIP(conn.RemoteAddr()); ip != nil {
+		if ban, ok := s.bans.banned(ip, time.Now()); ok {
+			conn.Close()
+			s.handleEvent(&ConnectionBannedEvent{
+				Listener:   l.name,
+				LocalAddr:  conn.LocalAddr(),
+				RemoteAddr: conn.RemoteAddr(),
+				Until:      ban.Until,
 			})
-			continue
-		default:
+			return
+		}
+	}
 
-			// Accept new connection
-			conn, err := s.listener.Accept()
-			if err != nil {
+	// Check connection rate limits
+	if ip := addrIP(conn.RemoteAddr()); s.limiter != nil && ip != nil {
+		if limit, ok := s.limiter.allow(ip, time.Now()); !ok {
+			conn.Close()
+			s.handleEvent(&ConnectionRateLimitedEvent{
+				Listener:   l.name,
+				LocalAddr:  conn.LocalAddr(),
+				RemoteAddr: conn.RemoteAddr(),
+				Limit:      limit,
+			})
+			return
+		}
+	}
 
-				// Connection timeout
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+	// Client key used for the per client limit. Empty keys are not limited.
+	key := s.clientKey(conn.RemoteAddr())
 
-					// Increase timeout deadline
-					deadline *= 2
+	s.connsMu.Lock()
 
-				} else {
+	// The server stopped while the connection was being accepted, after the
+	// open connections were closed
+	if s.ctx.Err() != nil || s.draining {
+		s.connsMu.Unlock()
+		conn.Close()
+		return
+	}
 
-					// Connection failed
-					s.handleEvent(&ConnectionFailedEvent{Error: err})
-				}
-				continue
-			}
-			// Successful connection. There may be more..
-			deadline = initialDeadline
-
-			// Get TCP connection
-			tcpConn := conn.(*net.TCPConn)
-			tcpAddr := tcpConn.RemoteAddr().(*net.TCPAddr)
-			ip := tcpAddr.IP.String()
-
-			// Check connection limit
-			if s.config.MaxConnections > 0 && openConnections >= s.config.MaxConnections {
-
-				// Too many connections; Close connection
-				tcpConn.Close()
-				s.handleEvent(&ConnectionClosedEvent{
-					LocalAddr:  tcpConn.LocalAddr(),
-					RemoteAddr: tcpConn.RemoteAddr(),
-				})
-				continue
-			}
+	// Check connection limit
+	if settings.maxConnections > 0 && l.conns >= settings.maxConnections {
+		s.connsMu.Unlock()
 
-			// Check max connections per IP
-			if s.config.MaxClientConnections > 0 {
-				if val, ok := clientConnections[ip]; ok && val >= s.config.MaxClientConnections {
-
-					// Too many connections per IP; Close connection
-					tcpConn.Close()
-					s.handleEvent(&ConnectionClosedEvent{
-						LocalAddr:  tcpConn.LocalAddr(),
-						RemoteAddr: tcpConn.RemoteAddr(),
-					})
-					continue
-				}
-			}
+		// Too many connections; Close connection
+		s.reject(l, settings, conn, LimitMaxConnections)
+		return
+	}
 
-			// Increment connection counters
-			wg.Add(1)
-			openConnections++
-			clientConnections[ip]++
+	// Check max connections per client
+	if settings.maxClientConnections > 0 && key != "" && l.clients[key] >= settings.maxClientConnections {
+		s.connsMu.Unlock()
 
-			// Max connections has been reached
-			if openConnections == s.config.MaxConnections {
-				s.handleEvent(&MaxConnectionsEvent{})
-			}
+		// Too many connections per client; Close connection
+		s.reject(l, settings, conn, LimitMaxClientConnections)
+		return
+	}
 
-			// Max client connections has been reached.
-			if clientConnections[ip] == s.config.MaxClientConnections {
-				s.handleEvent(&MaxClientConnectionsEvent{
-					LocalAddr:  tcpConn.LocalAddr(),
-					RemoteAddr: tcpConn.RemoteAddr(),
-				})
-			}
+	// Randomly drop connections while too many are in the handshake
+	if m := s.config.MaxStartups; m != nil && m.drop(s.startups, randomPercent) {
+		s.connsMu.Unlock()
 
-			// Connection will automatically expire after the deadline
-			if s.config.MaxConnectionDuration > 0 {
-				tcpConn.SetDeadline(time.Now().Add(s.config.MaxConnectionDuration))
-			}
+		s.reject(l, settings, conn, LimitMaxStartups)
+		return
+	}
 
-			// Handle connection
-			s.handleEvent(&ConnectionOpenedEvent{
-				LocalAddr:  tcpConn.LocalAddr(),
-				RemoteAddr: tcpConn.RemoteAddr(),
-			})
-			go s.handleTCPConn(tcpConn)
-		}
+	// Increment connection counters
+	s.wg.Add(1)
+	info := s.register(l, key, conn)
+	s.startups++
+	l.conns++
+	openConnections := l.conns
+	var clientConnections int
+	if key != "" {
+		l.clients[key]++
+		clientConnections = l.clients[key]
 	}
+	s.connsMu.Unlock()
 
-	// Wait for all connections to close
-	wg.Wait()
+	// Max connections has been reached
+	if openConnections == settings.maxConnections {
+		s.handleEvent(&MaxConnectionsEvent{Listener: l.name})
+	}
+
+	// Max client connections has been reached.
+	if key != "" && clientConnections == settings.maxClientConnections {
+		s.handleEvent(&MaxClientConnectionsEvent{
+			ConnectionID: info.id,
+			Listener:     l.name,
+			LocalAddr:    conn.LocalAddr(),
+			RemoteAddr:   conn.RemoteAddr(),
+		})
+	}
+
+	// Connection will automatically expire after the deadline
+	if settings.maxConnectionDuration > 0 {
+		conn.SetDeadline(time.Now().Add(settings.maxConnectionDuration))
+	}
+
+	// Handle connection
+	s.handleEvent(&ConnectionOpenedEvent{
+		ConnectionID: info.id,
+		Listener:     l.name,
+		LocalAddr:    conn.LocalAddr(),
+		RemoteAddr:   conn.RemoteAddr(),
+	})
+	go s.handleConn(settings, info)
 }
 
-func (s *Server) closeConn(tcpConn *net.TCPConn) {
-	tcpConn.Close()
-	s.closeCh <- tcpConn
+// clientKey returns the key used to account connections against MaxClientConnections.
+func (s *Server) clientKey(addr net.Addr) string {
+	if s.config.ClientKeyFunc != nil {
+		return s.config.ClientKeyFunc(addr)
+	}
+	return IPClientKey(addr)
+}
+
+// IPClientKey is the default ClientKeyFunc. It returns the IP of TCP addresses
+// and an empty key for all other address types, which skips the per client
+// limit for them.
+func IPClientKey(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return ""
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
 }
 
-func (s *Server) handleTCPConn(tcpConn *net.TCPConn) {
-	defer s.closeConn(tcpConn)
+func (s *Server) closeConn(conn net.Conn) {
+	defer s.wg.Done()
+	conn.Close()
+
+	// Decrement connection counters
+	s.connsMu.Lock()
+	info := s.conns[conn]
+	info.listener.conns--
+	if info.key != "" {
+		if info.listener.clients[info.key]--; info.listener.clients[info.key] <= 0 {
+			delete(info.listener.clients, info.key)
+		}
+	}
+	delete(s.conns, conn)
+	openConnections := len(s.conns)
+	draining := s.draining
+	s.connsMu.Unlock()
+
+	s.handleEvent(&ConnectionClosedEvent{
+		ConnectionID:  info.id,
+		Listener:      info.listener.name,
+		LocalAddr:     conn.LocalAddr(),
+		RemoteAddr:    conn.RemoteAddr(),
+		BytesReceived: atomic.LoadUint64(&info.received),
+		BytesSent:     atomic.LoadUint64(&info.sent),
+	})
+	if draining {
+		s.handleEvent(&DrainProgressEvent{Remaining: openConnections})
+	}
+}
 
-	// Allows for connection modification. Need to go back to net.Conn interface for easier wrapping.
-	var conn net.Conn = tcpConn
+func (s *Server) handleConn(settings *listenerSettings, info *connInfo) {
+	l, netConn := info.listener, info.conn
+	defer s.closeConn(netConn)
+
+	// Allows for connection modification and/or wrapping.
+	var conn net.Conn = &countingConn{netConn, info}
 	if s.config.ConnectionCallback != nil {
-		conn = s.config.ConnectionCallback(tcpConn)
+		conn = &countingConn{s.config.ConnectionCallback(netConn), info}
+	}
+
+	// Disconnect the client if the handshake and authentication take too long
+	var handshakeTimer *time.Timer
+	if settings.handshakeTimeout > 0 {
+		hc := &handshakeConn{Conn: conn, version: serverVersion(settings.sshConfig)}
+		conn = hc
+		handshakeTimer = time.AfterFunc(settings.handshakeTimeout, func() {
+			hc.disconnect(disconnectByApplication, handshakeTimeoutReason)
+		})
 	}
 
+	// Record the auth method and failed authentication attempts
+	sshConfig := *settings.sshConfig
+	if sshConfig.BannerCallback == nil {
+		sshConfig.BannerCallback = settings.bannerCallback
+	}
+	if s.bans.enabled() {
+		sshConfig.AuthLogCallback = s.bans.authLogCallback(netConn, sshConfig.AuthLogCallback)
+	}
+	sshConfig.AuthLogCallback = s.authLogCallback(info, sshConfig.AuthLogCallback)
+
 	// Convert to SSH connection
-	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, &sshConfig)
+	s.releaseStartup()
+	if handshakeTimer != nil && !handshakeTimer.Stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		s.handleEvent(&HandshakeTimeoutEvent{
+			ConnectionID: info.id,
+			Listener:     l.name,
+			LocalAddr:    netConn.LocalAddr(),
+			RemoteAddr:   netConn.RemoteAddr(),
+		})
+		return
+	}
 	if err != nil {
 		s.handleEvent(&HandshakeFailedEvent{
-			Error:      err,
-			LocalAddr:  tcpConn.LocalAddr(),
-			RemoteAddr: tcpConn.RemoteAddr(),
+			ConnectionID: info.id,
+			Listener:     l.name,
+			Error:        err,
+			LocalAddr:    netConn.LocalAddr(),
+			RemoteAddr:   netConn.RemoteAddr(),
 		})
 		return
 	}
 	s.handleEvent(&HandshakeSuccessfulEvent{
-		LocalAddr:  tcpConn.LocalAddr(),
-		RemoteAddr: tcpConn.RemoteAddr(),
+		ConnectionID: info.id,
+		Listener:     l.name,
+		LocalAddr:    netConn.LocalAddr(),
+		RemoteAddr:   netConn.RemoteAddr(),
 	})
 
 	// Close connection on exit
@@ -304,39 +667,100 @@ func (s *Server) handleTCPConn(tcpConn *net.TCPConn) {
 	defer sshConn.Wait()
 
 	// Handle global requests
-	ctx, cancel := context.WithCancel(WithServerConn(s.ctx, sshConn))
+	ctx := withDrainNotice(WithServerConn(s.ctx, sshConn), s.drainCh, s.config.ShutdownMessage)
+	ctx = withListenerName(ctx, l.name)
+	ctx = withMOTD(ctx, settings.motd)
+	state := newConnState(info.id, l.name, settings.sessionIdleTimeout, s.config.PanicPolicy, s.handleEvent)
+	ctx = withConnState(ctx, state)
+	info.authenticated(sshConn.User(), sshConn.Permissions, state)
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	go s.handleRequests(ctx, requests)
+	go s.handleRequests(ctx, info, settings, requests)
+
+	// Close the connection once no channel data has been sent for the idle timeout
+	if settings.idleTimeout > 0 {
+		go func() {
+			if state.activity.waitIdle(ctx, settings.idleTimeout) {
+				s.handleEvent(&ConnectionIdleTimeoutEvent{
+					ConnectionID: info.id,
+					Listener:     l.name,
+					Conn:         sshConn,
+				})
+				state.notifySessions(idleTimeoutMessage)
+				sshConn.Close()
+			}
+		}()
+	}
+
+	// Close the connection once the client stops answering keepalives
+	if settings.keepAliveInterval > 0 {
+		go s.keepAlive(ctx, info, settings, sshConn)
+	}
 
 	// Handle connection channels
+	opts := keyOptions(sshConn.Permissions)
 	for ch := range channels {
 
-		handler, found := s.config.ChannelHandlers[ch.ChannelType()]
+		// Refuse port forwarding to keys with the no-port-forwarding option
+		if opts != nil && opts.NoPortForwarding && forwardingChannels[ch.ChannelType()] {
+			ch.Reject(ssh.Prohibited, "port forwarding is not permitted")
+			continue
+		}
+
+		handler, found := settings.channelHandlers[ch.ChannelType()]
 		if !found {
 			ch.Reject(ssh.UnknownChannelType, "unsupported channel type")
 
 			s.handleEvent(&UnknownChannelEvent{
-				Conn:        sshConn,
-				ChannelType: ch.ChannelType(),
+				ConnectionID: info.id,
+				Listener:     l.name,
+				Conn:         sshConn,
+				ChannelType:  ch.ChannelType(),
 			})
 		} else {
 			s.handleEvent(&ChannelEvent{
-				Conn:        sshConn,
-				ChannelType: ch.ChannelType(),
+				ConnectionID: info.id,
+				Listener:     l.name,
+				Conn:         sshConn,
+				ChannelType:  ch.ChannelType(),
 			})
-			go handler.HandleChannel(ctx, ch)
+			go func(handler ChannelHandler, ch ssh.NewChannel) {
+				id := info.addChannel(ch.ChannelType())
+				defer info.removeChannel(id)
+				defer func() {
+					if state.recovers() {
+						if r := recover(); r != nil {
+							ch.Reject(ssh.ConnectionFailed, "server error")
+							state.panicked(sshConn, HandlerChannel, ch.ChannelType(), r)
+						}
+					}
+				}()
+				handler.HandleChannel(ctx, &activityNewChannel{ch, state.activity})
+			}(handler, ch)
 		}
 	}
 }
 
-func (s *Server) handleRequests(ctx context.Context, in <-chan *ssh.Request) {
+func (s *Server) handleRequests(ctx context.Context, info *connInfo, settings *listenerSettings, in <-chan *ssh.Request) {
 	conn, _ := SSHServerConn(ctx)
+	opts := keyOptions(conn.Permissions)
 	for req := range in {
-		handler, found := s.config.RequestHandlers[req.Type]
+
+		// Refuse port forwarding to keys with the no-port-forwarding option
+		if opts != nil && opts.NoPortForwarding && forwardingRequests[req.Type] {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		handler, found := settings.requestHandlers[req.Type]
 		if !found {
 			s.handleEvent(&UnknownRequestEvent{
-				RequestType: req.Type,
-				Conn:        conn,
+				ConnectionID: info.id,
+				Listener:     info.listener.name,
+				RequestType:  req.Type,
+				Conn:         conn,
 			})
 
 			if req.WantReply {
@@ -346,13 +770,30 @@ func (s *Server) handleRequests(ctx context.Context, in <-chan *ssh.Request) {
 		}
 
 		s.handleEvent(&RequestEvent{
-			RequestType: req.Type,
-			Conn:        conn,
+			ConnectionID: info.id,
+			Listener:     info.listener.name,
+			RequestType:  req.Type,
+			Conn:         conn,
 		})
 
-		ret, payload := handler.HandleRequest(ctx, req)
+		ret, payload := s.handleRequest(ctx, conn, handler, req)
 		if req.WantReply {
 			req.Reply(ret, payload)
 		}
 	}
 }
+
+// handleRequest runs the request handler. A recovered panic fails the request.
+func (s *Server) handleRequest(ctx context.Context, conn *ssh.ServerConn, handler RequestHandler, req *ssh.Request) (ret bool, payload []byte) {
+	if state, ok := connStateFromContext(ctx); ok {
+		defer func() {
+			if state.recovers() {
+				if r := recover(); r != nil {
+					ret, payload = false, nil
+					state.panicked(conn, HandlerRequest, req.Type, r)
+				}
+			}
+		}()
+	}
+	return handler.HandleRequest(ctx, req)
+}
@@ -0,0 +1,204 @@
+package shelob
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func newBenchSigner(b *testing.B) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return signer
+}
+
+func newBenchServer(b *testing.B) (*Server, net.Listener) {
+	srv, err := New(context.Background(), &Config{
+		PrivateKey:   newBenchSigner(b),
+		ServerConfig: &ssh.ServerConfig{NoClientAuth: true},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go srv.Serve(l)
+	return srv, l
+}
+
+// pollingServer is the baseline for the blocking accept loop. It reproduces
+// the polling loop the server used before: Accept polls with a deadline which
+// doubles up to MaxDeadline while idle, and closed connections are handed
+// back to the loop, which also does all the connection accounting.
+type pollingServer struct {
+	l           *net.TCPListener
+	sshConfig   *ssh.ServerConfig
+	maxDeadline time.Duration
+	closeCh     chan net.Conn
+	stopCh      chan struct{}
+	doneCh      chan struct{}
+}
+
+func newPollingServer(b *testing.B) *pollingServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sshConfig := &ssh.ServerConfig{NoClientAuth: true}
+	sshConfig.AddHostKey(newBenchSigner(b))
+	p := &pollingServer{
+		l:           l.(*net.TCPListener),
+		sshConfig:   sshConfig,
+		maxDeadline: time.Second,
+		closeCh:     make(chan net.Conn, 1),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *pollingServer) serve() {
+	defer close(p.doneCh)
+	initialDeadline := 5 * time.Millisecond
+	deadline := initialDeadline
+	var openConnections int
+	for {
+		if deadline > p.maxDeadline {
+			deadline = p.maxDeadline
+		}
+		p.l.SetDeadline(time.Now().Add(deadline))
+
+		select {
+		case <-p.stopCh:
+			p.l.Close()
+			return
+		case <-p.closeCh:
+			deadline = initialDeadline
+			openConnections--
+			continue
+		default:
+			conn, err := p.l.Accept()
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					deadline *= 2
+				}
+				continue
+			}
+			deadline = initialDeadline
+			openConnections++
+			go p.handleConn(conn)
+		}
+	}
+}
+
+func (p *pollingServer) handleConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		select {
+		case p.closeCh <- conn:
+		case <-p.doneCh:
+		}
+	}()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, p.sshConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		ch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	}
+}
+
+func (p *pollingServer) stop() {
+	close(p.stopCh)
+	<-p.doneCh
+}
+
+// BenchmarkConcurrentHandshakes measures connection throughput and the
+// average time from dial to a completed SSH handshake under load, for the
+// server's blocking accept loop and for the polling loop it replaced.
+func BenchmarkConcurrentHandshakes(b *testing.B) {
+	b.Run("blocking", func(b *testing.B) {
+		srv, l := newBenchServer(b)
+		defer srv.Stop()
+		benchmarkHandshakes(b, l.Addr().String())
+	})
+	b.Run("polling", func(b *testing.B) {
+		p := newPollingServer(b)
+		defer p.stop()
+		benchmarkHandshakes(b, p.l.Addr().String())
+	})
+}
+
+func benchmarkHandshakes(b *testing.B, addr string) {
+	clientConfig := &ssh.ClientConfig{
+		User:            "bench",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	var latency int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			dialed := time.Now()
+			client, err := ssh.Dial("tcp", addr, clientConfig)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			atomic.AddInt64(&latency, int64(time.Since(dialed)))
+			client.Close()
+		}
+	})
+	elapsed := time.Since(start)
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "conns/s")
+	b.ReportMetric(float64(latency)/float64(b.N), "ns/handshake")
+}
+
+// BenchmarkIdleStop measures how long stopping takes once the server has
+// been idle for a while. The polling loop only notices the stop when its
+// Accept deadline, which grows while idle, expires.
+func BenchmarkIdleStop(b *testing.B) {
+	const idle = 100 * time.Millisecond
+	measure := func(b *testing.B, start func() (stop func())) {
+		var elapsed time.Duration
+		for i := 0; i < b.N; i++ {
+			stop := start()
+			time.Sleep(idle)
+			stopped := time.Now()
+			stop()
+			elapsed += time.Since(stopped)
+		}
+		b.ReportMetric(float64(elapsed)/float64(b.N), "ns/stop")
+	}
+	b.Run("blocking", func(b *testing.B) {
+		measure(b, func() func() {
+			srv, _ := newBenchServer(b)
+			return srv.Stop
+		})
+	})
+	b.Run("polling", func(b *testing.B) {
+		measure(b, func() func() {
+			return newPollingServer(b).stop
+		})
+	})
+}
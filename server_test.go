@@ -1,401 +1,210 @@
 package shelob
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
-	"net/url"
-	"os"
+	"io"
 	"testing"
 	"time"
 
-	sshmocks "github.com/blacklabeldata/mockery/ssh"
-	"github.com/eliquious/sshh/router"
-	log "github.com/mgutz/logxi/v1"
-
-	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 )
 
-// TestUserTestSuite runs the UserTestSuite
-func TestServerSuite(t *testing.T) {
-	suite.Run(t, new(ServerSuite))
-}
-
-// ServerSuite tests SSH server
-type ServerSuite struct {
-	suite.Suite
-	server *SSHServer
-}
-
-func (suite *ServerSuite) createConfig() Config {
-
-	// Create logger
-	writer := log.NewConcurrentWriter(os.Stdout)
-	// writer := log.NewConcurrentWriter(ioutil.Discard)
-	logger := log.NewLogger(writer, "sshh")
-	// logger := log.DefaultLog
+// echoHandler echoes the lines written to its channels.
+type echoHandler struct{}
 
-	// Get signer
-	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+func (echoHandler) HandleChannel(ctx context.Context, newChannel ssh.NewChannel) {
+	ch, requests, err := newChannel.Accept()
 	if err != nil {
-		suite.Fail("Private key could not be parsed", err.Error())
+		return
 	}
+	defer ch.Close()
+	go ssh.DiscardRequests(requests)
 
-	r := router.New(logger, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	// Create config
-	cfg := Config{
-		Context:  context.Background(),
-		Deadline: time.Second,
-		Dispatcher: &UrlDispatcher{
-			Router: r,
-			Logger: logger,
-		},
-		// Handlers: map[string]SSHHandler{
-		// 	"echo": &EchoHandler{log.New("echo")},
-		// 	"bad":  &BadHandler{},
-		// },
-		Logger:            logger,
-		Bind:              ":9022",
-		PrivateKey:        signer,
-		PasswordCallback:  passwordCallback,
-		PublicKeyCallback: publicKeyCallback,
+	reader := bufio.NewReader(ch)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		ch.Write(line)
 	}
-	return cfg
 }
 
-// SetupTest prepares the suite before a test is ran.
-func (suite *ServerSuite) SetupTest() {
+// badHandler closes its channels at once, as a handler which failed.
+type badHandler struct{}
 
-	cfg := suite.createConfig()
-	server, err := New(&cfg)
+func (badHandler) HandleChannel(ctx context.Context, newChannel ssh.NewChannel) {
+	ch, requests, err := newChannel.Accept()
 	if err != nil {
-		suite.Fail("error creating server: " + err.Error())
+		return
 	}
-	suite.server = &server
-	suite.server.Start()
+	go ssh.DiscardRequests(requests)
+	ch.Close()
+}
+
+func startEchoServer(t *testing.T, clientKey ssh.Signer) string {
+	srv, addr := startTestServer(t, &Config{
+		ServerConfig: &ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if conn.User() == "jonny.quest" && string(password) == "bandit" {
+					return &ssh.Permissions{}, nil
+				}
+				return nil, errors.New("Invalid username or password")
+			},
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), clientKey.PublicKey().Marshal()) {
+					return nil, errors.New("Unauthorized")
+				}
+				return &ssh.Permissions{}, nil
+			},
+		},
+		ChannelHandlers: map[string]ChannelHandler{
+			"echo": echoHandler{},
+			"bad":  badHandler{},
+		},
+	})
+	t.Cleanup(srv.Stop)
+	return addr
 }
 
-// TearDownSuite cleans up suite state after all the tests have completed.
-func (suite *ServerSuite) TearDownTest() {
-	suite.server.Stop()
+func dialEchoServer(addr, user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
 }
 
-func (suite *ServerSuite) TestClientConnection() {
+func TestClientConnection(t *testing.T) {
+	clientKey := newTestSigner(t)
+	addr := startEchoServer(t, clientKey)
 
-	// Get signer
-	signer, err := ssh.ParsePrivateKey([]byte(clientPrivateKey))
-	if err != nil {
-		suite.Fail("Private key could not be parsed" + err.Error())
-	}
+	for _, auth := range []ssh.AuthMethod{ssh.PublicKeys(clientKey), ssh.Password("bandit")} {
+		client, err := dialEchoServer(addr, "jonny.quest", auth)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	// Configure client connection
-	config := &ssh.ClientConfig{
-		User: "admin",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
+		channel, requests, err := client.OpenChannel("echo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ssh.DiscardRequests(requests)
+		if _, err := io.WriteString(channel, "hello\n"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(channel).ReadString('\n')
+		if err != nil || line != "hello\n" {
+			t.Errorf("unexpected echo %q, %v", line, err)
+		}
+		channel.Close()
+		client.Close()
 	}
-
-	// Create client connection
-	client, err := ssh.Dial("tcp", "127.0.0.1:9022", config)
-	if err != nil {
-		suite.Fail(err.Error())
-		return
-	}
-	defer client.Close()
-
-	// Open channel
-	channel, requests, err := client.OpenChannel("/echo", []byte{})
-	if err != nil {
-		suite.Fail(err.Error())
-		return
-	}
-	go ssh.DiscardRequests(requests)
-	defer channel.Close()
 }
 
-func (suite *ServerSuite) TestUnknownChannel() {
+func TestUnauthorizedClient(t *testing.T) {
+	addr := startEchoServer(t, newTestSigner(t))
 
-	// Get signer
-	signer, err := ssh.ParsePrivateKey([]byte(clientPrivateKey))
-	if err != nil {
-		suite.Fail("Private key could not be parsed" + err.Error())
+	if _, err := dialEchoServer(addr, "jonny.quest", ssh.PublicKeys(newTestSigner(t))); err == nil {
+		t.Error("expected an unknown key to be refused")
 	}
-
-	// Configure client connection
-	config := &ssh.ClientConfig{
-		User: "admin",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
+	if _, err := dialEchoServer(addr, "jonny.quest", ssh.Password("hadji")); err == nil {
+		t.Error("expected a wrong password to be refused")
 	}
+}
 
-	// Create client connection
-	client, err := ssh.Dial("tcp", "127.0.0.1:9022", config)
+func TestUnknownChannel(t *testing.T) {
+	clientKey := newTestSigner(t)
+	addr := startEchoServer(t, clientKey)
+
+	client, err := dialEchoServer(addr, "admin", ssh.PublicKeys(clientKey))
 	if err != nil {
-		suite.Fail(err.Error())
-		return
+		t.Fatal(err)
 	}
 	defer client.Close()
 
-	// Open channel
-	_, _, err = client.OpenChannel("/shell", []byte{})
-	suite.NotNil(err, "server should not accept shell channels")
+	// Channel types are matched exactly, never parsed
+	for _, channelType := range []string{"shell", "*", ":/route", "https://user@example.com/api/route", "user@example.com/echo", "echo?%"} {
+		_, _, err = client.OpenChannel(channelType, nil)
+		openErr, ok := err.(*ssh.OpenChannelError)
+		if !ok || openErr.Reason != ssh.UnknownChannelType {
+			t.Errorf("expected the %q channel to be rejected as unknown, got %v", channelType, err)
+		}
+	}
 }
 
-func (suite *ServerSuite) TestHandlerError() {
+func TestHandlerError(t *testing.T) {
+	addr := startEchoServer(t, newTestSigner(t))
 
-	// Configure client connection
-	config := &ssh.ClientConfig{
-		User: "jonny.quest",
-		Auth: []ssh.AuthMethod{
-			ssh.Password("bandit"),
-		},
-	}
-
-	// Create client connection
-	client, err := ssh.Dial("tcp", "127.0.0.1:9022", config)
+	client, err := dialEchoServer(addr, "jonny.quest", ssh.Password("bandit"))
 	if err != nil {
-		suite.Fail(err.Error())
-		return
+		t.Fatal(err)
 	}
 	defer client.Close()
 
-	// Open channel
-	channel, requests, err := client.OpenChannel("/bad", []byte{})
+	channel, requests, err := client.OpenChannel("bad", nil)
 	if err != nil {
-		suite.Fail(err.Error())
-		return
+		t.Fatal(err)
 	}
 	go ssh.DiscardRequests(requests)
-	defer channel.Close()
-}
-
-func (suite *ServerSuite) TestUnacceptableChannel() {
-	// g := grim.Reaper()
-
-	r := router.New(log.NullLog, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	acceptErr := errors.New("accept error")
-	ch := &sshmocks.MockNewChannel{
-		TypeName:  "/echo",
-		AcceptErr: acceptErr,
+	if _, err := channel.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the channel to be closed, got %v", err)
 	}
-	ch.On("ChannelType").Return("/echo")
-	ch.On("Accept").Return(nil, nil, acceptErr)
-	ch.On("Reject", ChannelAcceptError, "/echo").Return(errors.New("unknown reason 1000"))
 
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
+	// The connection outlives the failed channel
+	channel, requests, err = client.OpenChannel("echo", nil)
+	if err != nil {
+		t.Fatalf("expected the connection to stay open, got %v", err)
 	}
-
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-	// g.SpawnFunc(channelHandler(g, log.NullLog, &serverConn, ch, r))
-	// g.Wait()
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Accept")
-	ch.AssertCalled(suite.T(), "Reject", ChannelAcceptError, "/echo")
-	conn.AssertCalled(suite.T(), "Close")
+	go ssh.DiscardRequests(requests)
+	channel.Close()
 }
 
-func (suite *ServerSuite) TestInvalidChannelType() {
-	// g := grim.Reaper()
-
-	r := router.New(log.NullLog, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	acceptErr := errors.New("accept error")
-	ch := &sshmocks.MockNewChannel{
-		TypeName:  ":/route",
-		AcceptErr: acceptErr,
-	}
-	ch.On("ChannelType").Return(":/route")
-	ch.On("Reject", InvalidChannelType, "invalid channel URI").Return(errors.New("unknown reason 1001"))
-
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
-	}
-
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-	// g.SpawnFunc(channelHandler(g, log.NullLog, &serverConn, ch, r))
-	// g.Wait()
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Reject", InvalidChannelType, "invalid channel URI")
-	conn.AssertCalled(suite.T(), "Close")
+// refusedChannel is a NewChannel which cannot be accepted.
+type refusedChannel struct {
+	rejected ssh.RejectionReason
 }
 
-func (suite *ServerSuite) TestSchemeNotSupported() {
-
-	r := router.New(log.NullLog, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	acceptErr := errors.New("accept error")
-	ch := &sshmocks.MockNewChannel{
-		TypeName:  "https://user@example.com/api/route",
-		AcceptErr: acceptErr,
-	}
-	ch.On("ChannelType").Return("https://user@example.com/api/route")
-	ch.On("Reject", SchemeNotSupported, "schemes are not supported in the channel URI").Return(errors.New("unknown reason 1002"))
-
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
-	}
-
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Reject", SchemeNotSupported, "schemes are not supported in the channel URI")
-	conn.AssertCalled(suite.T(), "Close")
+func (c *refusedChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, errors.New("accept error")
 }
 
-func (suite *ServerSuite) TestUserNotSupported() {
-	channel := "user@example.com/echo"
-	ch := &sshmocks.MockNewChannel{}
-	ch.On("Reject", UserNotSupported, "users are not supported in the channel URI").Return(errors.New("unknown reason 1005"))
-
-	uri := url.URL{
-		User: url.User("user"),
-	}
-	rejected := reject(channel, &uri, ch, log.NullLog)
-	suite.True(rejected, "channel should have been rejected")
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "Reject", UserNotSupported, "users are not supported in the channel URI")
+func (c *refusedChannel) Reject(reason ssh.RejectionReason, message string) error {
+	c.rejected = reason
+	return nil
 }
 
-func (suite *ServerSuite) TestHostNotSupported() {
-	channel := "user@example.com/echo"
-	ch := &sshmocks.MockNewChannel{}
-	ch.On("Reject", HostNotSupported, "hosts are not supported in the channel URI").Return(errors.New("unknown reason 1004"))
+func (c *refusedChannel) ChannelType() string { return "session" }
+func (c *refusedChannel) ExtraData() []byte   { return nil }
 
-	uri := url.URL{
-		Host: "example.com",
-	}
-	rejected := reject(channel, &uri, ch, log.NullLog)
-	suite.True(rejected, "channel should have been rejected")
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "Reject", HostNotSupported, "hosts are not supported in the channel URI")
+// closeRecorder records whether the connection was closed.
+type closeRecorder struct {
+	ssh.Conn
+	closed bool
 }
 
-func (suite *ServerSuite) TestInvalidQueryParams() {
-
-	channel := "/echo?%"
-	r := router.New(log.NullLog, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	acceptErr := errors.New("accept error")
-	ch := &sshmocks.MockNewChannel{
-		TypeName:  channel,
-		AcceptErr: acceptErr,
-	}
-	ch.On("ChannelType").Return(channel)
-	ch.On("Reject", InvalidQueryParams, "invalid query params in channel type").Return(errors.New("unknown reason 1002"))
-
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
-	}
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Reject", InvalidQueryParams, "invalid query params in channel type")
-	conn.AssertCalled(suite.T(), "Close")
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
 }
 
-func (suite *ServerSuite) TestChannelHandleError() {
-
-	channel := "/bad"
-	r := router.New(log.NullLog, nil, nil)
-	r.Register("/bad", &BadHandler{})
-
-	c := &sshmocks.MockChannel{}
-	c.On("Close").Return(nil)
+func TestUnacceptableChannel(t *testing.T) {
+	conn := &closeRecorder{}
+	ch := &refusedChannel{}
+	handler := NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+		t.Error("expected the handler not to be called")
+		return 0
+	}, false, false)
+	handler.HandleChannel(WithServerConn(context.Background(), &ssh.ServerConn{Conn: conn}), ch)
 
-	ch := &sshmocks.MockNewChannel{
-		TypeName: channel,
-		Channel:  c,
+	if ch.rejected != ssh.ConnectionFailed {
+		t.Errorf("expected the channel to be rejected, got %v", ch.rejected)
 	}
-	ch.On("ChannelType").Return(channel)
-	ch.On("Accept").Return(c, nil, nil)
-	ch.On("Reject", ChannelHandleError, "error handling channel: an error occurred").
-		Return(errors.New("error handling channel: an error occurred"))
-
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
+	if !conn.closed {
+		t.Error("expected the connection to be closed")
 	}
-
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Accept")
-	ch.AssertCalled(suite.T(), "Reject", ChannelHandleError, "error handling channel: an error occurred")
-	c.AssertCalled(suite.T(), "Close")
-	conn.AssertCalled(suite.T(), "Close")
-}
-
-func (suite *ServerSuite) TestWildcard() {
-
-	writer := log.NewConcurrentWriter(os.Stdout)
-	logger := log.NewLogger(writer, "sshh_test")
-
-	r := router.New(logger, nil, nil)
-	r.Register("/echo", &EchoHandler{log.New("echo")})
-	r.Register("/bad", &BadHandler{})
-
-	acceptErr := errors.New("accept error")
-	ch := &sshmocks.MockNewChannel{
-		TypeName:  "*",
-		AcceptErr: acceptErr,
-	}
-	ch.On("ChannelType").Return("*")
-	ch.On("Reject", ssh.UnknownChannelType, "*").Return(errors.New("unknown reason 1000"))
-
-	conn := &sshmocks.MockConn{}
-	conn.On("Close").Return(nil)
-	serverConn := ssh.ServerConn{
-		Conn: conn,
-	}
-	// Create dispatcher
-	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
-	dispatcher.Dispatch(context.Background(), &serverConn, ch)
-
-	// assert that the expectations were met
-	ch.AssertCalled(suite.T(), "ChannelType")
-	ch.AssertCalled(suite.T(), "Reject", ssh.UnknownChannelType, "*")
-	conn.AssertCalled(suite.T(), "Close")
 }
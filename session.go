@@ -2,9 +2,13 @@ package shelob
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	// "github.com/google/shlex"
 
@@ -46,6 +50,23 @@ type Session interface {
 	// setup in the auth handlers.
 	Permissions() *ssh.Permissions
 
+	// AuthMethod returns the method the user authenticated with, one of the
+	// AuthMethod constants. When an AuthPolicy required several methods, it is
+	// the completed chain separated by commas, as in ConnectionInfo.
+	AuthMethod() string
+
+	// AuthMethods returns the methods of the AuthMethod, in order.
+	AuthMethods() []string
+
+	// KeyOptions returns the options of the authorized_keys entry or the
+	// restrictions of the certificate the user authenticated with, or nil.
+	KeyOptions() *KeyOptions
+
+	// Certificate returns the user certificate used to authenticate, with its
+	// key ID, serial, principals and extensions. It returns nil if the user
+	// did not authenticate with a certificate.
+	Certificate() *ssh.Certificate
+
 	// Pty returns PTY information, a channel of window size changes, and a boolean
 	// of whether or not a PTY was accepted for this session.
 	Pty() (Pty, <-chan Window, bool)
@@ -92,6 +113,25 @@ func (s *sessionChannelHandler) HandleChannel(ctx context.Context, newch ssh.New
 	}
 	defer ch.Close()
 
+	// Close the session once no data has been sent for the idle timeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if state, ok := connStateFromContext(ctx); ok && state.sessionIdleTimeout > 0 {
+		sessionActivity := newActivity()
+		ch = &activityChannel{ch, sessionActivity}
+		go func() {
+			if sessionActivity.waitIdle(ctx, state.sessionIdleTimeout) {
+				state.handleEvent(&SessionIdleTimeoutEvent{
+					ConnectionID: state.id,
+					Listener:     state.listener,
+					Conn:         conn,
+				})
+				ch.Stderr().Write([]byte(idleTimeoutMessage))
+				cancel()
+			}
+		}()
+	}
+
 	s.handleRequests(ctx, conn, ch, reqs)
 }
 
@@ -102,35 +142,52 @@ func (s *sessionChannelHandler) handleRequests(ctx context.Context, conn *ssh.Se
 	signalChCh := make(chan chan<- os.Signal)
 	signalBuffer := []os.Signal{}
 
-	// Close/exit channels
-	closeCh := make(chan struct{}, 0)
-	exitCh := make(chan int, 0)
-	exitErrorCh := make(chan error, 0)
-	defer close(closeCh)
-	defer close(exitCh)
-	defer close(exitErrorCh)
+	// Graceful shutdown notice
+	notice, _ := ctx.Value(keyDrainNotice).(drainNotice)
+	drainCh := notice.ch
+
+	// Close/exit channels. doneCh is closed when the request loop returns so
+	// late calls to Close or Exit from the handler do not block or panic.
+	doneCh := make(chan struct{})
+	closeCh := make(chan struct{})
+	exitCh := make(chan exitStatus)
+	exitErrorCh := make(chan error, 1)
+	defer close(doneCh)
 
 	// Create session
 	sess := &session{
 		Channel:     ch,
 		conn:        conn,
 		signalChCh:  signalChCh,
+		doneCh:      doneCh,
 		closeCh:     closeCh,
 		exitCh:      exitCh,
 		exitErrorCh: exitErrorCh,
+		keyOptions:  keyOptions(conn.Permissions),
 		handler:     s.handler,
+		state:       &connState{},
 	}
+
+	// Register the session for connection wide notices
+	if state, ok := connStateFromContext(ctx); ok {
+		sess.state = state
+		state.addSession(sess)
+		defer state.removeSession(sess)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-closeCh:
 			return
-		case code := <-exitCh:
-
-			status := struct{ Status uint32 }{uint32(code)}
-			_, err := sess.Channel.SendRequest("exit-status", false, ssh.Marshal(&status))
-			exitErrorCh <- err
+		case <-drainCh:
+			drainCh = nil
+			if notice.message != "" {
+				ch.Stderr().Write([]byte(notice.message))
+			}
+		case status := <-exitCh:
+			exitErrorCh <- sess.sendExitStatus(status)
 			return
 		case sigCh := <-signalChCh:
 			signalCh = sigCh
@@ -143,8 +200,11 @@ func (s *sessionChannelHandler) handleRequests(ctx context.Context, conn *ssh.Se
 					}
 				}(signalCh, signalBuffer)
 			}
-		case req := <-reqs:
-			if req == nil {
+		case req, ok := <-reqs:
+			if !ok {
+
+				// Channel closed; wait for the handler to exit
+				reqs = nil
 				continue
 			}
 
@@ -184,25 +244,21 @@ func (s *sessionChannelHandler) handleRequests(ctx context.Context, conn *ssh.Se
 				}
 
 			case "pty-req":
-				if !s.allowPty {
+				if !s.allowPty || sess.keyOptions != nil && sess.keyOptions.NoPty {
 					req.Reply(false, nil)
 					continue
 				}
 				sess.handlePtyReq(req)
 
 			case "window-change":
-				if sess.pty == nil {
+				win, ok := parseWinchRequest(req.Payload)
+				if !ok || !sess.setWindow(win) {
 					req.Reply(false, nil)
 					continue
 				}
-				win, ok := parseWinchRequest(req.Payload)
-				if ok {
-					sess.pty.Window = win
-					sess.winch <- win
-				}
 				req.Reply(ok, nil)
 			case agentRequestType:
-				if s.allowAgentFwd {
+				if s.allowAgentFwd && (sess.keyOptions == nil || !sess.keyOptions.NoAgentForwarding) {
 
 					atomic.StoreUint64(&sess.agentRequested, 1)
 					req.Reply(true, nil)
@@ -213,7 +269,6 @@ func (s *sessionChannelHandler) handleRequests(ctx context.Context, conn *ssh.Se
 				// TODO: debug log
 				req.Reply(false, nil)
 			}
-		default:
 		}
 	}
 }
@@ -229,21 +284,34 @@ type session struct {
 	exited         uint64
 	agentRequested uint64
 
-	conn    *ssh.ServerConn
-	handler SessionHandler
-	env     []string
-	cmd     []string
+	conn       *ssh.ServerConn
+	state      *connState
+	keyOptions *KeyOptions
+	handler    SessionHandler
+	env        []string
+	cmd        []string
 
+	// ptyMu guards pty, which the request loop updates while the handler reads it.
+	ptyMu sync.Mutex
 	pty   *Pty
 	winch chan Window
 
 	signalChCh chan chan<- os.Signal
 
+	doneCh      chan struct{}
 	closeCh     chan struct{}
-	exitCh      chan int
+	exitCh      chan exitStatus
 	exitErrorCh chan error
 }
 
+// exitStatus is sent to the client when the session ends. The signal is sent
+// in place of the exit code if set.
+type exitStatus struct {
+	code    int
+	signal  string
+	message string
+}
+
 func (s *session) handle(ctx context.Context, req *ssh.Request) {
 	if !atomic.CompareAndSwapUint64(&s.handled, 0, 1) {
 		req.Reply(false, nil)
@@ -256,8 +324,85 @@ func (s *session) handle(ctx context.Context, req *ssh.Request) {
 	ssh.Unmarshal(req.Payload, &payload)
 	s.cmd, _ = shlex.Split(trimQuotes(payload.Value))
 
+	// Apply the authorized_keys options; a forced command replaces the command of the client
+	if opts := s.keyOptions; opts != nil {
+		s.env = append(s.env, opts.Environment...)
+		if opts.Command != "" {
+			if req.Type == "exec" {
+				s.env = append(s.env, "SSH_ORIGINAL_COMMAND="+payload.Value)
+			}
+			s.cmd, _ = shlex.Split(opts.Command)
+		}
+	}
+	_, _, hasPty := s.Pty()
+	interactive := req.Type == "shell" && hasPty
+
 	// Run handler and exit when finished
-	go s.Exit(s.handler(ctx, s))
+	go func() {
+		started := time.Now()
+		s.handleEvent(&SessionStartedEvent{
+			ConnectionID: s.state.id,
+			Listener:     s.state.listener,
+			Conn:         s.conn,
+			Command:      s.Command(),
+		})
+		status, recovered := s.run(ctx, interactive)
+		s.handleEvent(&SessionEndedEvent{
+			ConnectionID: s.state.id,
+			Listener:     s.state.listener,
+			Conn:         s.conn,
+			ExitCode:     status.code,
+			Duration:     time.Since(started),
+		})
+		if recovered {
+			s.Stderr().Write([]byte(panicMessage))
+		}
+		s.exit(status)
+	}()
+}
+
+// run writes the message of the day to interactive sessions and runs the
+// handler. If either panics and the panic is recovered the session ends with
+// the panicExitSignal.
+func (s *session) run(ctx context.Context, interactive bool) (status exitStatus, recovered bool) {
+	defer func() {
+		if s.state.recovers() {
+			if r := recover(); r != nil {
+				status = exitStatus{code: 128 + 6, signal: panicExitSignal, message: "handler panic"}
+				recovered = true
+				s.state.panicked(s.conn, HandlerSession, "session", r)
+			}
+		}
+	}()
+	if interactive {
+		s.writeMOTD(ctx)
+	}
+	return exitStatus{code: s.handler(ctx, s)}, false
+}
+
+// sendExitStatus sends the exit-status, or the exit-signal if set, of the session.
+func (s *session) sendExitStatus(status exitStatus) error {
+	if status.signal != "" {
+		msg := struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{status.signal, false, status.message, ""}
+		_, err := s.Channel.SendRequest("exit-signal", false, ssh.Marshal(&msg))
+		return err
+	}
+
+	msg := struct{ Status uint32 }{uint32(status.code)}
+	_, err := s.Channel.SendRequest("exit-status", false, ssh.Marshal(&msg))
+	return err
+}
+
+// handleEvent emits the event if the session belongs to a server connection.
+func (s *session) handleEvent(evt Event) {
+	if s.state.handleEvent != nil {
+		s.state.handleEvent(evt)
+	}
 }
 
 func trimQuotes(s string) string {
@@ -294,7 +439,10 @@ func (s *session) User() string {
 }
 
 func (s *session) Close() error {
-	s.closeCh <- struct{}{}
+	select {
+	case s.closeCh <- struct{}{}:
+	case <-s.doneCh:
+	}
 	return s.conn.Wait()
 }
 
@@ -319,10 +467,18 @@ func (s *session) WriteString(msg string) (int, error) {
 }
 
 func (s *session) Exit(code int) error {
+	return s.exit(exitStatus{code: code})
+}
+
+func (s *session) exit(status exitStatus) error {
 	if !atomic.CompareAndSwapUint64(&s.exited, 0, 1) {
 		return fmt.Errorf("exit called more than once")
 	}
-	s.exitCh <- code
+	select {
+	case s.exitCh <- status:
+	case <-s.doneCh:
+		return io.EOF
+	}
 
 	// defer s.conn.Close()
 	// defer s.Channel.Close()
@@ -337,25 +493,43 @@ func (s *session) Exit(code int) error {
 }
 
 func (s *session) handlePtyReq(req *ssh.Request) {
-	if s.hasBeenHandled() {
-		req.Reply(false, nil)
-		return
-	} else if s.pty != nil {
+	ptyReq, ok := parsePtyRequest(req.Payload)
+	if !ok || s.hasBeenHandled() {
 		req.Reply(false, nil)
 		return
 	}
 
-	ptyReq, ok := parsePtyRequest(req.Payload)
-	if !ok {
+	s.ptyMu.Lock()
+	if s.pty != nil {
+		s.ptyMu.Unlock()
 		req.Reply(false, nil)
 		return
 	}
 	s.pty = &ptyReq
 	s.winch = make(chan Window, 1)
 	s.winch <- ptyReq.Window
+	s.ptyMu.Unlock()
 	req.Reply(ok, nil)
 }
 
+// setWindow updates the window size of the PTY and notifies the handler. A
+// size the handler has not received yet is replaced, so the request loop
+// never blocks on a handler which is not reading window changes.
+func (s *session) setWindow(win Window) bool {
+	s.ptyMu.Lock()
+	defer s.ptyMu.Unlock()
+	if s.pty == nil {
+		return false
+	}
+	s.pty.Window = win
+	select {
+	case <-s.winch:
+	default:
+	}
+	s.winch <- win
+	return true
+}
+
 func (s *session) PublicKey() ssh.PublicKey {
 	perms := s.conn.Permissions
 	if perms == nil {
@@ -377,7 +551,34 @@ func (s *session) Permissions() *ssh.Permissions {
 	return s.conn.Permissions
 }
 
+func (s *session) AuthMethod() string {
+	if perms := s.conn.Permissions; perms != nil && perms.Extensions != nil {
+		if methods, ok := perms.Extensions[permAuthMethods]; ok {
+			return methods
+		}
+		if method, ok := perms.Extensions[permAuthMethod]; ok {
+			return method
+		}
+	}
+	return AuthMethodNone
+}
+
+func (s *session) AuthMethods() []string {
+	return strings.Split(s.AuthMethod(), ",")
+}
+
+func (s *session) KeyOptions() *KeyOptions {
+	return s.keyOptions
+}
+
+func (s *session) Certificate() *ssh.Certificate {
+	cert, _ := s.PublicKey().(*ssh.Certificate)
+	return cert
+}
+
 func (s *session) Pty() (Pty, <-chan Window, bool) {
+	s.ptyMu.Lock()
+	defer s.ptyMu.Unlock()
 	if s.pty != nil {
 		return *s.pty, s.winch, true
 	}
@@ -26,6 +26,23 @@ type OptionFunc func(*Config) error
 
 // ListenAndServe starts the server with the options.
 func ListenAndServe(addr string, opts ...OptionFunc) error {
+	srv, err := newServer(addr, opts...)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
+
+// Serve starts the server with the options on an existing listener.
+func Serve(l net.Listener, opts ...OptionFunc) error {
+	srv, err := newServer(l.Addr().String(), opts...)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+func newServer(addr string, opts ...OptionFunc) (*Server, error) {
 	conf := &Config{
 		Addr:            addr,
 		MaxDeadline:     time.Second,
@@ -42,17 +59,20 @@ func ListenAndServe(addr string, opts ...OptionFunc) error {
 	// Read opts
 	for _, opt := range opts {
 		if err := opt(conf); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// Create and start server
+	// Create server
 	ctx := context.Background()
-	srv, err := New(ctx, conf)
-	if err != nil {
-		return err
+	return New(ctx, conf)
+}
+
+func WithListener(lc ListenerConfig) OptionFunc {
+	return func(conf *Config) error {
+		conf.Listeners = append(conf.Listeners, lc)
+		return nil
 	}
-	return srv.ListenAndServe()
 }
 
 func WithMaxConnections(conns int) OptionFunc {
@@ -69,6 +89,71 @@ func WithMaxClientConnections(conns int) OptionFunc {
 	}
 }
 
+func WithMaxStartups(startups string) OptionFunc {
+	return func(conf *Config) error {
+		m, err := ParseMaxStartups(startups)
+		if err != nil {
+			return err
+		}
+		conf.MaxStartups = &m
+		return nil
+	}
+}
+
+func WithClientKeyFunc(fn func(net.Addr) string) OptionFunc {
+	return func(conf *Config) error {
+		conf.ClientKeyFunc = fn
+		return nil
+	}
+}
+
+func WithProxyProtocol(trustedCIDRs ...string) OptionFunc {
+	return func(conf *Config) error {
+		nets, err := ParseCIDRs(trustedCIDRs...)
+		if err != nil {
+			return err
+		}
+		conf.TrustedProxies = nets
+		return nil
+	}
+}
+
+func WithAllowedNetworks(cidrs ...string) OptionFunc {
+	return func(conf *Config) error {
+		nets, err := ParseCIDRs(cidrs...)
+		if err != nil {
+			return err
+		}
+		conf.AllowedNetworks = nets
+		return nil
+	}
+}
+
+func WithDeniedNetworks(cidrs ...string) OptionFunc {
+	return func(conf *Config) error {
+		nets, err := ParseCIDRs(cidrs...)
+		if err != nil {
+			return err
+		}
+		conf.DeniedNetworks = nets
+		return nil
+	}
+}
+
+func WithRateLimit(limit RateLimitConfig) OptionFunc {
+	return func(conf *Config) error {
+		conf.RateLimit = &limit
+		return nil
+	}
+}
+
+func WithBans(bans BanConfig) OptionFunc {
+	return func(conf *Config) error {
+		conf.Bans = &bans
+		return nil
+	}
+}
+
 func WithMaxDeadline(deadline time.Duration) OptionFunc {
 	return func(conf *Config) error {
 		conf.MaxDeadline = deadline
@@ -83,6 +168,35 @@ func WithMaxConnectionDuration(timeout time.Duration) OptionFunc {
 	}
 }
 
+func WithHandshakeTimeout(timeout time.Duration) OptionFunc {
+	return func(conf *Config) error {
+		conf.HandshakeTimeout = timeout
+		return nil
+	}
+}
+
+func WithIdleTimeout(timeout time.Duration) OptionFunc {
+	return func(conf *Config) error {
+		conf.IdleTimeout = timeout
+		return nil
+	}
+}
+
+func WithSessionIdleTimeout(timeout time.Duration) OptionFunc {
+	return func(conf *Config) error {
+		conf.SessionIdleTimeout = timeout
+		return nil
+	}
+}
+
+func WithKeepAlive(interval time.Duration, maxMissed int) OptionFunc {
+	return func(conf *Config) error {
+		conf.KeepAliveInterval = interval
+		conf.KeepAliveMaxMissed = maxMissed
+		return nil
+	}
+}
+
 func WithRequestHandler(reqType string, handler RequestHandler) OptionFunc {
 	return func(conf *Config) error {
 		conf.RequestHandlers[reqType] = handler
@@ -111,6 +225,13 @@ func WithEventHandler(handler EventHandler) OptionFunc {
 	}
 }
 
+func WithMetrics(m *Metrics) OptionFunc {
+	return func(conf *Config) error {
+		conf.EventHandler = MultiEventHandler(conf.EventHandler, m.HandleEvent)
+		return nil
+	}
+}
+
 func WithHostKey(signer ssh.Signer) OptionFunc {
 	return func(conf *Config) error {
 		conf.PrivateKey = signer
@@ -143,6 +264,72 @@ func WithSignalCh(ch chan os.Signal) OptionFunc {
 	}
 }
 
+func WithShutdownMessage(msg string) OptionFunc {
+	return func(conf *Config) error {
+		conf.ShutdownMessage = msg
+		return nil
+	}
+}
+
+func WithSignalAction(sig os.Signal, action SignalAction) OptionFunc {
+	return func(conf *Config) error {
+		if conf.SignalActions == nil {
+			conf.SignalActions = make(map[os.Signal]SignalAction)
+		}
+		conf.SignalActions[sig] = action
+		return nil
+	}
+}
+
+func WithReloadFunc(fn ReloadFunc) OptionFunc {
+	return func(conf *Config) error {
+		conf.ReloadFunc = fn
+		return nil
+	}
+}
+
+func WithDrainTimeout(timeout time.Duration) OptionFunc {
+	return func(conf *Config) error {
+		conf.DrainTimeout = timeout
+		return nil
+	}
+}
+
+func WithUpgradeCommand(args ...string) OptionFunc {
+	return func(conf *Config) error {
+		conf.UpgradeCommand = args
+		return nil
+	}
+}
+
+func WithBanner(banner string) OptionFunc {
+	return func(conf *Config) error {
+		conf.Banner = banner
+		return nil
+	}
+}
+
+func WithBannerCallback(cb func(conn ssh.ConnMetadata) string) OptionFunc {
+	return func(conf *Config) error {
+		conf.BannerCallback = cb
+		return nil
+	}
+}
+
+func WithMOTD(motd MOTDFunc) OptionFunc {
+	return func(conf *Config) error {
+		conf.MOTD = motd
+		return nil
+	}
+}
+
+func WithPanicPolicy(policy PanicPolicy) OptionFunc {
+	return func(conf *Config) error {
+		conf.PanicPolicy = policy
+		return nil
+	}
+}
+
 func WithServerConfig(c *ssh.ServerConfig) OptionFunc {
 	return func(conf *Config) error {
 		conf.ServerConfig = c
@@ -194,6 +381,89 @@ func WithPublicKeyAuth(pubkey ssh.PublicKey) OptionFunc {
 	}
 }
 
+func WithKeyboardInteractiveAuth(instruction string, questions []Question, verify KeyboardInteractiveVerifier) OptionFunc {
+	return func(conf *Config) error {
+		if conf.ServerConfig == nil {
+			return fmt.Errorf("err: server config is nil")
+		}
+
+		conf.ServerConfig.KeyboardInteractiveCallback = keyboardInteractiveCallback(instruction, questions, verify)
+		return nil
+	}
+}
+
+func WithTOTPAuth(totp *TOTP) OptionFunc {
+	return func(conf *Config) error {
+		if conf.ServerConfig == nil {
+			return fmt.Errorf("err: server config is nil")
+		}
+		if totp == nil || totp.Store == nil {
+			return fmt.Errorf("err: TOTP secret store is nil")
+		}
+		if err := totp.validate(); err != nil {
+			return err
+		}
+
+		conf.ServerConfig.KeyboardInteractiveCallback = totp.keyboardInteractiveCallback()
+		return nil
+	}
+}
+
+func WithAuthorizedKeysFiles(files ...string) OptionFunc {
+	return func(conf *Config) error {
+		conf.AuthorizedKeysFiles = append(conf.AuthorizedKeysFiles, files...)
+		return nil
+	}
+}
+
+func WithPasswordFile(file string) OptionFunc {
+	return func(conf *Config) error {
+		conf.PasswordFile = file
+		return nil
+	}
+}
+
+func WithUserCertificateAuthority(caKeys ...ssh.PublicKey) OptionFunc {
+	return func(conf *Config) error {
+		conf.UserCertificateAuthorities = append(conf.UserCertificateAuthorities, caKeys...)
+		return nil
+	}
+}
+
+func WithCertificatePrincipals(fn func(user string) []string) OptionFunc {
+	return func(conf *Config) error {
+		conf.CertificatePrincipals = fn
+		return nil
+	}
+}
+
+func WithCertificateRevocation(isRevoked func(cert *ssh.Certificate) bool) OptionFunc {
+	return func(conf *Config) error {
+		conf.IsRevoked = isRevoked
+		return nil
+	}
+}
+
+func WithAuthPolicy(policy func(user string) AuthPolicy) OptionFunc {
+	return func(conf *Config) error {
+		conf.AuthPolicy = policy
+		return nil
+	}
+}
+
+func WithAuthenticationMethods(methods string) OptionFunc {
+	return func(conf *Config) error {
+		policy, err := ParseAuthPolicy(methods)
+		if err != nil {
+			return err
+		}
+		conf.AuthPolicy = func(user string) AuthPolicy {
+			return policy
+		}
+		return nil
+	}
+}
+
 func WithAuthLogCallback(cb func(conn ssh.ConnMetadata, method string, err error)) OptionFunc {
 	return func(conf *Config) error {
 		if conf.ServerConfig == nil {
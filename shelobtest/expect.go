@@ -0,0 +1,99 @@
+package shelobtest
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultExpectTimeout is used by Expect if the timeout is zero.
+const DefaultExpectTimeout = 5 * time.Second
+
+// ansiEscape matches terminal escape sequences: CSI sequences such as colors
+// and cursor movement, OSC sequences such as window titles, and two character
+// escapes such as charset selection.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[ -/]*[0-Z\\^-~]`)
+
+// partialEscape matches an escape sequence which has not been fully written yet.
+var partialEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*|\][^\x07\x1b]*\x1b?|[ -/]*)$`)
+
+// StripANSI removes terminal escape sequences and carriage returns, leaving
+// the text as it would be seen on the terminal.
+func StripANSI(s string) string {
+	return strings.Replace(ansiEscape.ReplaceAllString(s, ""), "\r", "", -1)
+}
+
+// Dial connects to the SSH server at the address, eg. a server which is not
+// running in the test process. The client is closed when the test finishes.
+func Dial(t testing.TB, addr string, conf *ssh.ClientConfig) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", addr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// Transcript returns the visible text the session has written so far.
+func (p *PtySession) Transcript() string {
+	return StripANSI(p.Output())
+}
+
+// Expect waits until the visible text written since the previous match matches
+// the regular expression and returns the match and its submatches. The test
+// fails if there is no match within the timeout, or DefaultExpectTimeout if zero.
+func (p *PtySession) Expect(re *regexp.Regexp, timeout time.Duration) []string {
+	p.t.Helper()
+
+	if timeout == 0 {
+		timeout = DefaultExpectTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		p.mu.Lock()
+		text := StripANSI(partialEscape.ReplaceAllString(p.output.String(), ""))
+		changed := p.changed
+		if loc := re.FindStringSubmatchIndex(text[p.expected:]); loc != nil {
+			match := make([]string, len(loc)/2)
+			for i := range match {
+				if loc[2*i] >= 0 {
+					match[i] = text[p.expected+loc[2*i] : p.expected+loc[2*i+1]]
+				}
+			}
+			p.expected += loc[1]
+			p.mu.Unlock()
+			return match
+		}
+		pending := text[p.expected:]
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			p.t.Fatalf("timed out after %s expecting %q, got %q", timeout, re, pending)
+			return nil
+		}
+	}
+}
+
+// ExpectString waits until the visible text written since the previous match
+// contains the string, see Expect.
+func (p *PtySession) ExpectString(s string, timeout time.Duration) {
+	p.t.Helper()
+	p.Expect(regexp.MustCompile(regexp.QuoteMeta(s)), timeout)
+}
+
+// SendLine writes the line followed by the enter key.
+func (p *PtySession) SendLine(line string) {
+	p.t.Helper()
+	p.Send(line + "\r")
+}
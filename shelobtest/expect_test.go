@@ -0,0 +1,96 @@
+package shelobtest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/eliquious/shelob"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// repl is an interactive handler with a colored prompt which reports window
+// changes and exits on an interrupt.
+func repl(ctx context.Context, s shelob.Session) int {
+	_, winCh, _ := s.Pty()
+	sigCh := make(chan os.Signal, 1)
+	s.Signals(sigCh)
+
+	lineCh := make(chan string)
+	go func() {
+		defer close(lineCh)
+		r := bufio.NewReader(s)
+		for {
+			line, err := r.ReadString('\r')
+			if err != nil {
+				return
+			}
+			lineCh <- strings.TrimSuffix(line, "\r")
+		}
+	}()
+
+	prompt := "\x1b[1;32m>>>\x1b[0m "
+	fmt.Fprintf(s, "\x1b]0;repl\x07welcome %s\r\n%s", s.User(), prompt)
+	for {
+		select {
+		case line, ok := <-lineCh:
+			if !ok || line == "exit" {
+				return 0
+			}
+			fmt.Fprintf(s, "\x1b[33m%s\x1b[0m\r\n%s", strings.ToUpper(line), prompt)
+		case win := <-winCh:
+			fmt.Fprintf(s, "\r\nresized %dx%d\r\n%s", win.Width, win.Height, prompt)
+		case <-sigCh:
+			fmt.Fprint(s, "^C\r\n")
+			return 130
+		}
+	}
+}
+
+func TestExpect(t *testing.T) {
+	srv := newTestServer(t, repl)
+	p := StartPty(t, srv.Client("alice"), "", 80, 24)
+
+	if m := p.Expect(regexp.MustCompile(`welcome (\w+)\n>>> `), 0); m[1] != "alice" {
+		t.Errorf("unexpected match %q", m)
+	}
+	p.ExpectString("resized 80x24\n>>> ", 0)
+	p.SendLine("hello")
+	p.ExpectString("HELLO\n>>> ", 0)
+
+	p.Resize(120, 40)
+	p.Expect(regexp.MustCompile(`resized 120x40`), 0)
+
+	p.SendSignal(ssh.SIGINT)
+	p.ExpectString("^C", 0)
+	p.AssertExitCode(130)
+
+	expected := "welcome alice\n>>> \nresized 80x24\n>>> HELLO\n>>> \nresized 120x40\n>>> ^C\n"
+	if transcript := p.Transcript(); transcript != expected {
+		t.Errorf("expected transcript %q, got %q", expected, transcript)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"\x1b[1;31mred\x1b[0m", "red"},
+		{"\x1b[2J\x1b[Hclear", "clear"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b]0;title\x1b\\text", "text"},
+		{"line\r\n", "line\n"},
+		{"\x1b7saved\x1b8", "saved"},
+		{"\x1b(Bcharset", "charset"},
+	}
+	for _, tt := range tests {
+		if out := StripANSI(tt.in); out != tt.out {
+			t.Errorf("StripANSI(%q): expected %q, got %q", tt.in, tt.out, out)
+		}
+	}
+}
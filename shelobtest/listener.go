@@ -0,0 +1,210 @@
+package shelobtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrListenerClosed is returned when dialing or accepting on a closed Listener.
+var ErrListenerClosed = errors.New("shelobtest: listener closed")
+
+// Listener is an in-memory net.Listener. Connections are created with Dial.
+type Listener struct {
+	connCh    chan net.Conn
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates an in-memory listener.
+func NewListener() *Listener {
+	return &Listener{
+		connCh: make(chan net.Conn),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// Accept waits for the next call to Dial.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.doneCh:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops the listener. Connections which were accepted stay open.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.doneCh)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr("server")
+}
+
+// Dial connects to the listener. It blocks until the connection is accepted.
+func (l *Listener) Dial() (net.Conn, error) {
+	server, client := newPipe()
+	select {
+	case l.connCh <- server:
+		return client, nil
+	case <-l.doneCh:
+		server.Close()
+		client.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+type pipeAddr string
+
+func (pipeAddr) Network() string  { return "pipe" }
+func (a pipeAddr) String() string { return string(a) }
+
+// newPipe creates a connected pair of in-memory connections. Unlike net.Pipe
+// writes are buffered, as both sides of an SSH handshake write before reading.
+func newPipe() (server, client *pipeConn) {
+	toServer, toClient := newPipeBuffer(), newPipeBuffer()
+	server = &pipeConn{r: toServer, w: toClient, local: "server", remote: "client"}
+	client = &pipeConn{r: toClient, w: toServer, local: "client", remote: "server"}
+	return server, client
+}
+
+// pipeBuffer holds the bytes written to one side of a pipe.
+type pipeBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	deadline time.Time
+
+	// readerClosed is set when the reading side closed, writerClosed when
+	// the writing side did.
+	readerClosed bool
+	writerClosed bool
+
+	// changed is closed and replaced when any of the fields change.
+	changed chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{changed: make(chan struct{})}
+}
+
+// notify wakes up waiting readers. Guarded by mu.
+func (b *pipeBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		switch {
+		case b.readerClosed:
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		case b.buf.Len() > 0:
+			n, _ := b.buf.Read(p)
+			b.mu.Unlock()
+			return n, nil
+		case b.writerClosed:
+			b.mu.Unlock()
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			b.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		changed, deadline := b.changed, b.deadline
+		b.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (b *pipeBuffer) write(p []byte, deadline time.Time) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.writerClosed:
+		return 0, net.ErrClosed
+	case b.readerClosed:
+		return 0, io.ErrClosedPipe
+	case !deadline.IsZero() && !time.Now().Before(deadline):
+		return 0, os.ErrDeadlineExceeded
+	}
+	b.buf.Write(p)
+	b.notify()
+	return len(p), nil
+}
+
+// pipeConn is one side of an in-memory connection.
+type pipeConn struct {
+	r, w          *pipeBuffer
+	local, remote pipeAddr
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return c.w.write(p, deadline)
+}
+
+func (c *pipeConn) Close() error {
+	c.r.mu.Lock()
+	c.r.readerClosed = true
+	c.r.notify()
+	c.r.mu.Unlock()
+
+	c.w.mu.Lock()
+	c.w.writerClosed = true
+	c.w.notify()
+	c.w.mu.Unlock()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.r.mu.Lock()
+	c.r.deadline = t
+	c.r.notify()
+	c.r.mu.Unlock()
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package shelobtest provides an in-memory shelob server and SSH client for
+// testing handlers without real sockets, and an expect-style driver for
+// interactive PTY sessions.
+package shelobtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/eliquious/shelob"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// Server is a shelob.Server serving on an in-memory Listener.
+type Server struct {
+	*shelob.Server
+
+	// Listener accepts the client connections.
+	Listener *Listener
+
+	// HostKey is the host key of the server.
+	HostKey ssh.Signer
+
+	// UserKey is accepted for every user if the config did not provide a
+	// ssh.ServerConfig.
+	UserKey ssh.Signer
+
+	t testing.TB
+}
+
+// NewServer starts a server with the config on an in-memory listener. A
+// throwaway host key is generated if the config has none, and a ServerConfig
+// accepting UserKey is used if the config has none. The server is stopped
+// when the test finishes.
+func NewServer(t testing.TB, conf *shelob.Config) *Server {
+	t.Helper()
+
+	s := &Server{
+		Listener: NewListener(),
+		HostKey:  NewKey(t),
+		UserKey:  NewKey(t),
+		t:        t,
+	}
+	if conf.PrivateKey != nil {
+		s.HostKey = conf.PrivateKey
+	}
+	conf.PrivateKey = s.HostKey
+
+	if conf.ServerConfig == nil {
+		userKey := s.UserKey.PublicKey().Marshal()
+		conf.ServerConfig = &ssh.ServerConfig{
+			PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), userKey) {
+					return nil, ssh.ErrNoAuth
+				}
+				return &ssh.Permissions{}, nil
+			},
+		}
+	}
+
+	srv, err := shelob.New(context.Background(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Server = srv
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(s.Listener)
+	}()
+	t.Cleanup(func() {
+		srv.Stop()
+		if err := <-errCh; err != nil {
+			t.Errorf("shelobtest: serve: %s", err)
+		}
+	})
+	return s
+}
+
+// NewKey generates a throwaway ed25519 key.
+func NewKey(t testing.TB) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Client connects to the server as the user, authenticating with UserKey.
+// The client is closed when the test finishes.
+func (s *Server) Client(user string) *ssh.Client {
+	s.t.Helper()
+	return s.ClientWithConfig(&ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(s.UserKey)},
+	})
+}
+
+// ClientWithConfig connects to the server with the client config. The host key
+// is verified against HostKey if the config has no HostKeyCallback. The client
+// is closed when the test finishes.
+func (s *Server) ClientWithConfig(conf *ssh.ClientConfig) *ssh.Client {
+	s.t.Helper()
+
+	client, err := s.Dial(conf)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// Dial connects to the server with the client config and returns the
+// handshake error, for testing authentication failures.
+func (s *Server) Dial(conf *ssh.ClientConfig) (*ssh.Client, error) {
+	if conf.HostKeyCallback == nil {
+		conf.HostKeyCallback = ssh.FixedHostKey(s.HostKey.PublicKey())
+	}
+
+	conn, err := s.Listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "shelobtest", conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
@@ -0,0 +1,168 @@
+package shelobtest
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result is the output and exit code of a command.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// AssertExitCode fails the test if the command exited with another code.
+func (r Result) AssertExitCode(t testing.TB, code int) {
+	t.Helper()
+	if r.ExitCode != code {
+		t.Fatalf("expected exit code %d, got %d\nstdout: %s\nstderr: %s", code, r.ExitCode, r.Stdout, r.Stderr)
+	}
+}
+
+// Exec runs the command in a new session and returns its output and exit code.
+func Exec(t testing.TB, client *ssh.Client, cmd string) Result {
+	t.Helper()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	code, err := ExitCode(sess.Run(cmd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Result{stdout.String(), stderr.String(), code}
+}
+
+// ExitCode returns the exit code of the error returned by ssh.Session.Run or
+// ssh.Session.Wait. Errors which are not exit statuses are returned.
+func ExitCode(err error) (int, error) {
+	switch e := err.(type) {
+	case nil:
+		return 0, nil
+	case *ssh.ExitError:
+		return e.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// PtySession is an interactive session with a pseudo terminal.
+type PtySession struct {
+	*ssh.Session
+	t testing.TB
+
+	// Stdin writes to the session.
+	Stdin io.WriteCloser
+
+	mu     sync.Mutex
+	output bytes.Buffer
+
+	// changed is closed and replaced when output is written.
+	changed chan struct{}
+
+	// expected is the length of the visible text consumed by Expect.
+	expected int
+}
+
+// StartPty requests a PTY of the size and starts a shell, or the command if not empty.
+func StartPty(t testing.TB, client *ssh.Client, cmd string, width, height int) *PtySession {
+	t.Helper()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PtySession{Session: sess, t: t, changed: make(chan struct{})}
+	if p.Stdin, err = sess.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	sess.Stdout = (*ptyWriter)(p)
+	sess.Stderr = (*ptyWriter)(p)
+
+	if err := sess.RequestPty("xterm", height, width, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if cmd == "" {
+		err = sess.Shell()
+	} else {
+		err = sess.Start(cmd)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sess.Close()
+	})
+	return p
+}
+
+type ptyWriter PtySession
+
+func (w *ptyWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+	return w.output.Write(b)
+}
+
+// Output returns everything the session has written so far, including
+// terminal escape sequences. See Transcript for the visible text.
+func (p *PtySession) Output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.output.String()
+}
+
+// Send writes the input to the session.
+func (p *PtySession) Send(input string) {
+	p.t.Helper()
+	if _, err := io.WriteString(p.Stdin, input); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// Resize sends a window change.
+func (p *PtySession) Resize(width, height int) {
+	p.t.Helper()
+	if err := p.WindowChange(height, width); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// SendSignal sends the signal to the session.
+func (p *PtySession) SendSignal(sig ssh.Signal) {
+	p.t.Helper()
+	if err := p.Session.Signal(sig); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// ExitCode waits for the session to exit and returns its exit code.
+func (p *PtySession) ExitCode() int {
+	p.t.Helper()
+	code, err := ExitCode(p.Wait())
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return code
+}
+
+// AssertExitCode waits for the session to exit and fails the test if it
+// exited with another code.
+func (p *PtySession) AssertExitCode(code int) {
+	p.t.Helper()
+	if actual := p.ExitCode(); actual != code {
+		p.t.Fatalf("expected exit code %d, got %d\noutput: %s", code, actual, p.Output())
+	}
+}
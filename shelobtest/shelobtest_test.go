@@ -0,0 +1,101 @@
+package shelobtest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eliquious/shelob"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func newTestServer(t *testing.T, handler shelob.SessionHandler) *Server {
+	return NewServer(t, &shelob.Config{
+		ChannelHandlers: map[string]shelob.ChannelHandler{
+			"session": shelob.NewSessionChannelHandler(handler, true, false),
+		},
+	})
+}
+
+func TestExec(t *testing.T) {
+	srv := newTestServer(t, func(ctx context.Context, s shelob.Session) int {
+		fmt.Fprintf(s, "%s %s", s.User(), strings.Join(s.Command(), ","))
+		fmt.Fprint(s.Stderr(), "stderr")
+		return 3
+	})
+
+	res := Exec(t, srv.Client("alice"), "echo 'hello world'")
+	res.AssertExitCode(t, 3)
+	if res.Stdout != "alice echo,hello world" {
+		t.Errorf("unexpected stdout %q", res.Stdout)
+	}
+	if res.Stderr != "stderr" {
+		t.Errorf("unexpected stderr %q", res.Stderr)
+	}
+}
+
+func TestUnauthorizedKey(t *testing.T) {
+	srv := newTestServer(t, func(ctx context.Context, s shelob.Session) int {
+		return 0
+	})
+
+	_, err := srv.Dial(&ssh.ClientConfig{
+		User: "mallory",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(NewKey(t))},
+	})
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestPtySession(t *testing.T) {
+	srv := newTestServer(t, func(ctx context.Context, s shelob.Session) int {
+		pty, winCh, ok := s.Pty()
+		if !ok {
+			return 1
+		}
+		fmt.Fprintf(s, "pty %s %dx%d\n", pty.Term, pty.Window.Width, pty.Window.Height)
+
+		sigCh := make(chan os.Signal, 1)
+		s.Signals(sigCh)
+		for {
+			select {
+			case win := <-winCh:
+				fmt.Fprintf(s, "window %dx%d\n", win.Width, win.Height)
+			case sig := <-sigCh:
+				fmt.Fprintf(s, "signal %s\n", sig)
+				return 130
+			}
+		}
+	})
+
+	p := StartPty(t, srv.Client("alice"), "", 80, 24)
+	p.Resize(100, 40)
+	waitForOutput(t, p, "window 100x40")
+	p.SendSignal(ssh.SIGINT)
+	p.AssertExitCode(130)
+
+	out := p.Output()
+
+	// The resize may arrive before the handler reads the PTY
+	if !strings.Contains(out, "pty xterm 80x24") && !strings.Contains(out, "pty xterm 100x40") {
+		t.Errorf("unexpected output %q", out)
+	}
+	if !strings.Contains(out, "signal "+syscall.SIGINT.String()) {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func waitForOutput(t *testing.T, p *PtySession, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(p.Output(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, got %q", want, p.Output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+package shelob
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	var mu sync.Mutex
+	var started, progress bool
+	conf := &Config{
+		ShutdownMessage: "going down\n",
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				<-Draining(ctx)
+
+				// Give the server time to start draining
+				time.Sleep(50 * time.Millisecond)
+				return 0
+			}, false, false),
+		},
+		EventHandler: func(evt Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch evt.(type) {
+			case *DrainStartedEvent:
+				started = true
+			case *DrainProgressEvent:
+				progress = true
+			}
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("expected graceful shutdown, got %v", err)
+	}
+	sess.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !started || !progress {
+		t.Fatalf("expected drain events started=%v progress=%v", started, progress)
+	}
+	if stderr.String() != "going down\n" {
+		t.Fatalf("unexpected shutdown message %q", stderr.String())
+	}
+}
+
+func TestShutdownKillsAfterDeadline(t *testing.T) {
+	var mu sync.Mutex
+	var killed int
+	var srv *Server
+	conf := &Config{
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				<-ctx.Done()
+				return 0
+			}, false, false),
+		},
+		EventHandler: func(evt Event) {
+			if _, ok := evt.(*ConnectionKilledEvent); ok {
+
+				// Handlers may inspect the server while connections are killed
+				srv.Stats()
+				srv.Connections()
+				mu.Lock()
+				killed++
+				mu.Unlock()
+			}
+		},
+	}
+	srv, addr := startTestServer(t, conf)
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if killed != 1 {
+		t.Fatalf("expected 1 killed connection, got %d", killed)
+	}
+}
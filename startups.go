@@ -0,0 +1,78 @@
+package shelob
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// MaxStartups limits the concurrent unauthenticated connections of the server,
+// like the sshd option of the same name. Once Start connections are in the SSH
+// handshake, new connections are dropped with a probability of Rate percent,
+// which increases linearly to 100 percent at Full.
+type MaxStartups struct {
+	Start int
+	Rate  int
+	Full  int
+}
+
+// ParseMaxStartups parses the sshd format "start:rate:full". A single number
+// is a hard limit.
+func ParseMaxStartups(s string) (MaxStartups, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return MaxStartups{}, fmt.Errorf("invalid MaxStartups %q", s)
+	}
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return MaxStartups{}, fmt.Errorf("invalid MaxStartups %q", s)
+		}
+		values[i] = v
+	}
+
+	m := MaxStartups{Start: values[0], Rate: 100, Full: values[0]}
+	if len(values) == 3 {
+		m = MaxStartups{Start: values[0], Rate: values[1], Full: values[2]}
+	}
+	return m, m.validate()
+}
+
+func (m MaxStartups) validate() error {
+	if m.Start <= 0 || m.Full < m.Start || m.Rate < 0 || m.Rate > 100 {
+		return fmt.Errorf("invalid MaxStartups %d:%d:%d", m.Start, m.Rate, m.Full)
+	}
+	return nil
+}
+
+func (m MaxStartups) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.Start, m.Rate, m.Full)
+}
+
+// drop reports whether a new connection is dropped while n connections are in
+// the handshake. percent returns a random number in [0,100).
+func (m MaxStartups) drop(n int, percent func() int) bool {
+	switch {
+	case n >= m.Full:
+		return true
+	case n < m.Start:
+		return false
+	}
+	p := m.Rate + (100-m.Rate)*(n-m.Start)/(m.Full-m.Start)
+	return percent() < p
+}
+
+// randomPercent returns a random number in [0,100).
+func randomPercent() int {
+	return rand.Intn(100)
+}
+
+// releaseStartup releases the handshake slot of a connection once its SSH
+// handshake finished.
+func (s *Server) releaseStartup() {
+	s.connsMu.Lock()
+	s.startups--
+	s.connsMu.Unlock()
+}
@@ -0,0 +1,106 @@
+package shelob
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseMaxStartups(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected MaxStartups
+		err      bool
+	}{
+		{"10:30:100", MaxStartups{10, 30, 100}, false},
+		{"5", MaxStartups{5, 100, 5}, false},
+		{"10:30", MaxStartups{}, true},
+		{"10:130:100", MaxStartups{}, true},
+		{"10:30:5", MaxStartups{}, true},
+		{"a:b:c", MaxStartups{}, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseMaxStartups(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+		} else if !tt.err && m != tt.expected {
+			t.Errorf("%q: expected %+v, got %+v", tt.in, tt.expected, m)
+		}
+	}
+}
+
+func TestMaxStartupsDrop(t *testing.T) {
+	m := MaxStartups{Start: 10, Rate: 30, Full: 20}
+	tests := []struct {
+		n, percent int
+		drop       bool
+	}{
+		{9, 0, false},
+		{10, 29, true},
+		{10, 30, false},
+		{15, 64, true},
+		{15, 65, false},
+		{19, 92, true},
+		{20, 99, true},
+	}
+	for _, tt := range tests {
+		percent := func() int { return tt.percent }
+		if drop := m.drop(tt.n, percent); drop != tt.drop {
+			t.Errorf("n=%d percent=%d: expected drop=%v", tt.n, tt.percent, tt.drop)
+		}
+	}
+}
+
+func TestMaxStartups(t *testing.T) {
+	rejected := make(chan *ConnectionRejectedEvent, 1)
+	srv, addr := startTestServer(t, &Config{
+		MaxStartups: &MaxStartups{Start: 1, Rate: 100, Full: 1},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ConnectionRejectedEvent); ok {
+				rejected <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	// An authenticated connection does not hold a handshake slot
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	// A connection which never sends its version holds the only slot
+	halfOpen, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Stats().Handshakes != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case e := <-rejected:
+		if e.Limit != LimitMaxStartups {
+			t.Fatalf("unexpected limit %s", e.Limit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be dropped")
+	}
+
+	// The slot is released once the handshake fails
+	halfOpen.Close()
+	for srv.Stats().Handshakes != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the handshake slot to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialTestServer(t, addr).Close()
+}
@@ -0,0 +1,38 @@
+package shelob
+
+// Stats is a snapshot of the server's connection counters.
+type Stats struct {
+	Connections int
+
+	// Handshakes is the number of connections in the SSH handshake.
+	Handshakes int
+	Draining   bool
+	Listeners  []ListenerStats
+}
+
+// ListenerStats is a snapshot of a listener's connection counters.
+type ListenerStats struct {
+	Name        string
+	Connections int
+	Clients     int
+}
+
+// Stats returns a snapshot of the server's connection counters.
+func (s *Server) Stats() Stats {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	stats := Stats{
+		Connections: len(s.conns),
+		Handshakes:  s.startups,
+		Draining:    s.draining,
+	}
+	for _, l := range s.listeners {
+		stats.Listeners = append(stats.Listeners, ListenerStats{
+			Name:        l.name,
+			Connections: l.conns,
+			Clients:     len(l.clients),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,161 @@
+package shelob
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	events := make(chan Event, 1)
+	srv, addr := startTestServer(t, &Config{
+		HandshakeTimeout: 50 * time.Millisecond,
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*HandshakeTimeoutEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	// Connect without starting a handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected HandshakeTimeoutEvent")
+	}
+
+	// The client is told why, before and during the key exchange
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, _ := ioutil.ReadAll(conn); !bytes.Contains(data, []byte(handshakeTimeoutReason)) {
+		t.Errorf("expected a disconnect message, got %q", data)
+	}
+
+	kex, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kex.Close()
+	if _, err := kex.Write([]byte("SSH-2.0-Test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	kex.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, _ := ioutil.ReadAll(kex); !bytes.Contains(data, []byte(handshakeTimeoutReason)) {
+		t.Errorf("expected a disconnect message after the KEXINIT, got %q", data)
+	}
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	events := make(chan Event, 1)
+	srv, addr := startTestServer(t, &Config{
+		IdleTimeout: 50 * time.Millisecond,
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*ConnectionIdleTimeoutEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected ConnectionIdleTimeoutEvent")
+	}
+	client.Wait()
+}
+
+func TestConnectionIdleTimeoutStalledClient(t *testing.T) {
+	srv, addr := startTestServer(t, &Config{
+		IdleTimeout: 100 * time.Millisecond,
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+
+				// Fill the window of a client which never reads
+				s.Write(make([]byte, 8<<20))
+				return 0
+			}, false, false),
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.StdoutPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.StderrPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the idle connection of a client which is not reading to be closed")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	events := make(chan Event, 1)
+	srv, addr := startTestServer(t, &Config{
+		SessionIdleTimeout: 50 * time.Millisecond,
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				<-ctx.Done()
+				return 0
+			}, false, false),
+		},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*SessionIdleTimeoutEvent); ok {
+				events <- e
+			}
+		},
+	})
+	defer srv.Stop()
+
+	client := dialTestServer(t, addr)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected SessionIdleTimeoutEvent")
+	}
+	sess.Wait()
+	if stderr.String() != idleTimeoutMessage {
+		t.Fatalf("unexpected disconnect reason %q", stderr.String())
+	}
+}
@@ -0,0 +1,184 @@
+package shelob
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TOTPSecretStore returns the TOTP secrets of users. A nil secret without an
+// error means the user has no second factor and is refused.
+type TOTPSecretStore interface {
+	TOTPSecret(user string) ([]byte, error)
+}
+
+// TOTPSecrets is a TOTPSecretStore of fixed secrets by user.
+type TOTPSecrets map[string][]byte
+
+// TOTPSecret returns the secret of the user.
+func (s TOTPSecrets) TOTPSecret(user string) ([]byte, error) {
+	return s[user], nil
+}
+
+// DecodeTOTPSecret decodes a base32 secret, as shown by authenticator apps
+// and otpauth:// URLs. Spaces and padding are optional.
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+var errInvalidTOTP = errors.New("ssh: invalid verification code")
+
+// TOTP verifies RFC 6238 time-based one-time passwords. A code is accepted
+// once, so a code seen by someone else cannot be used again.
+type TOTP struct {
+
+	// Store returns the secrets of users.
+	Store TOTPSecretStore
+
+	// Digits is the length of the codes, 6 to 8. Defaults to 6.
+	Digits int
+
+	// Period is the time step of the codes, a whole number of seconds.
+	// Defaults to 30 seconds.
+	Period time.Duration
+
+	// Skew is the number of time steps before and after the current one
+	// whose codes are accepted, for clients with a drifting clock.
+	Skew int
+
+	// Hash is the HMAC hash function, with a size of at least 20 bytes.
+	// Defaults to SHA-1, which is what authenticator apps use.
+	Hash func() hash.Hash
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu   sync.Mutex
+	used map[string]uint64
+}
+
+func (t *TOTP) digits() int {
+	if t.Digits <= 0 {
+		return 6
+	}
+	return t.Digits
+}
+
+// validate checks the parameters which would make every code invalid or
+// which the computation of codes does not support.
+func (t *TOTP) validate() error {
+	if t.Period < 0 || t.Period%time.Second != 0 {
+		return fmt.Errorf("invalid TOTP period %s, expected whole seconds", t.Period)
+	}
+	if t.Digits != 0 && (t.Digits < 6 || t.Digits > 8) {
+		return fmt.Errorf("invalid TOTP digits %d, expected 6 to 8", t.Digits)
+	}
+
+	// The dynamic truncation reads 4 bytes at an offset of up to 15
+	if t.Hash != nil && t.Hash().Size() < sha1.Size {
+		return fmt.Errorf("invalid TOTP hash, expected at least %d bytes", sha1.Size)
+	}
+	return nil
+}
+
+func (t *TOTP) counter(at time.Time) uint64 {
+	seconds := uint64(t.Period / time.Second)
+	if seconds == 0 {
+		seconds = 30
+	}
+	return uint64(at.Unix()) / seconds
+}
+
+// Code returns the code of the secret at the time.
+func (t *TOTP) Code(secret []byte, at time.Time) string {
+	return t.code(secret, t.counter(at))
+}
+
+// code computes the RFC 4226 HOTP value of the counter.
+func (t *TOTP) code(secret []byte, counter uint64) string {
+	h := t.Hash
+	if h == nil {
+		h = sha1.New
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(h, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	digits := t.digits()
+	mod := uint32(1)
+	for i := 0; i < digits && i < 9; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Verify reports whether the code is valid for the user. Codes of the time
+// steps within Skew are accepted, but never a code of a time step at or
+// before one already used by the user.
+func (t *TOTP) Verify(user, code string) (bool, error) {
+	if err := t.validate(); err != nil {
+		return false, err
+	}
+	secret, err := t.Store.TOTPSecret(user)
+	if err != nil || secret == nil {
+		return false, err
+	}
+
+	now := time.Now
+	if t.Now != nil {
+		now = t.Now
+	}
+	current := t.counter(now())
+	code = strings.TrimSpace(code)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := -t.Skew; i <= t.Skew; i++ {
+		if i < 0 && uint64(-i) > current {
+			continue
+		}
+		counter := current + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(t.code(secret, counter)), []byte(code)) != 1 {
+			continue
+		}
+		if last, ok := t.used[user]; ok && counter <= last {
+			return false, nil
+		}
+		if t.used == nil {
+			t.used = make(map[string]uint64)
+		}
+		t.used[user] = counter
+		return true, nil
+	}
+	return false, nil
+}
+
+// keyboardInteractiveCallback prompts for a verification code.
+func (t *TOTP) keyboardInteractiveCallback() func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	questions := []Question{{Prompt: "Verification code: "}}
+	return keyboardInteractiveCallback("", questions, func(conn ssh.ConnMetadata, answers []string) (*ssh.Permissions, error) {
+		ok, err := t.Verify(conn.User(), answers[0])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errInvalidTOTP
+		}
+		return &ssh.Permissions{}, nil
+	})
+}
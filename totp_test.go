@@ -0,0 +1,197 @@
+package shelob
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238 appendix B
+	sha1Secret := []byte("12345678901234567890")
+	sha256Secret := []byte("12345678901234567890123456789012")
+	vectors := []struct {
+		unix   int64
+		sha1   string
+		sha256 string
+	}{
+		{59, "94287082", "46119246"},
+		{1111111109, "07081804", "68084774"},
+		{1234567890, "89005924", "91819424"},
+		{20000000000, "65353130", "77737706"},
+	}
+	totp := &TOTP{Digits: 8}
+	totp256 := &TOTP{Digits: 8, Hash: sha256.New}
+	for _, v := range vectors {
+		at := time.Unix(v.unix, 0)
+		if code := totp.Code(sha1Secret, at); code != v.sha1 {
+			t.Errorf("%d: expected %s, got %s", v.unix, v.sha1, code)
+		}
+		if code := totp256.Code(sha256Secret, at); code != v.sha256 {
+			t.Errorf("%d: expected SHA-256 %s, got %s", v.unix, v.sha256, code)
+		}
+	}
+
+	secret, err := DecodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil || string(secret) != string(sha1Secret) {
+		t.Errorf("unexpected secret %q, %v", secret, err)
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	totp := &TOTP{
+		Store: TOTPSecrets{"alice": secret, "bob": secret},
+		Skew:  1,
+		Now:   func() time.Time { return now },
+	}
+
+	previous := totp.Code(secret, now.Add(-30*time.Second))
+	current := totp.Code(secret, now)
+	if ok, _ := totp.Verify("alice", totp.Code(secret, now.Add(-time.Minute))); ok {
+		t.Error("expected a code outside the skew window to be refused")
+	}
+	if ok, _ := totp.Verify("carol", current); ok {
+		t.Error("expected a user without a secret to be refused")
+	}
+	if ok, _ := totp.Verify("alice", current); !ok {
+		t.Fatal("expected the current code to be accepted")
+	}
+	if ok, _ := totp.Verify("alice", current); ok {
+		t.Error("expected a replayed code to be refused")
+	}
+	if ok, _ := totp.Verify("alice", previous); ok {
+		t.Error("expected an earlier code to be refused after a later one was used")
+	}
+	if ok, _ := totp.Verify("bob", previous); !ok {
+		t.Error("expected the code of the previous time step within the skew")
+	}
+	now = now.Add(30 * time.Second)
+	if ok, _ := totp.Verify("alice", totp.Code(secret, now)); !ok {
+		t.Error("expected the code of the next time step to be accepted")
+	}
+}
+
+func TestTOTPPeriod(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, period := range []time.Duration{500 * time.Millisecond, 1500 * time.Millisecond, -time.Second} {
+		totp := &TOTP{Store: TOTPSecrets{"alice": secret}, Period: period}
+		totp.Code(secret, time.Now())
+		if ok, err := totp.Verify("alice", "000000"); ok || err == nil {
+			t.Errorf("%s: expected the period to be refused, got %v %v", period, ok, err)
+		}
+		if err := WithTOTPAuth(totp)(&Config{ServerConfig: &ssh.ServerConfig{}}); err == nil {
+			t.Errorf("%s: expected WithTOTPAuth to refuse the period", period)
+		}
+	}
+
+	now := time.Now()
+	totp := &TOTP{Store: TOTPSecrets{"alice": secret}, Period: time.Second, Now: func() time.Time { return now }}
+	if ok, err := totp.Verify("alice", totp.Code(secret, now)); !ok || err != nil {
+		t.Errorf("expected a 1s period to be accepted, got %v %v", ok, err)
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for name, totp := range map[string]*TOTP{
+		"5 digits":  {Digits: 5},
+		"9 digits":  {Digits: 9},
+		"10 digits": {Digits: 10},
+		"md5":       {Hash: md5.New},
+	} {
+		totp.Store = TOTPSecrets{"alice": secret}
+		if ok, err := totp.Verify("alice", "00000000"); ok || err == nil {
+			t.Errorf("%s: expected the TOTP to be refused, got %v %v", name, ok, err)
+		}
+		if err := WithTOTPAuth(totp)(&Config{ServerConfig: &ssh.ServerConfig{}}); err == nil {
+			t.Errorf("%s: expected WithTOTPAuth to refuse the TOTP", name)
+		}
+	}
+	for _, digits := range []int{0, 6, 8} {
+		if err := (&TOTP{Digits: digits, Hash: sha256.New}).validate(); err != nil {
+			t.Errorf("%d digits: %v", digits, err)
+		}
+	}
+}
+
+type failingTOTPStore struct{}
+
+func (failingTOTPStore) TOTPSecret(user string) ([]byte, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestTOTPAuth(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	totp := &TOTP{Store: TOTPSecrets{"alice": secret}}
+
+	methods := make(chan string, 1)
+	sshConfig := &ssh.ServerConfig{}
+	conf := &Config{
+		ServerConfig: sshConfig,
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": NewSessionChannelHandler(func(ctx context.Context, s Session) int {
+				methods <- s.AuthMethod()
+				return 0
+			}, false, false),
+		},
+	}
+	if err := WithTOTPAuth(totp)(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithTOTPAuth(&TOTP{})(conf); err == nil {
+		t.Error("expected a TOTP without a store to fail")
+	}
+	srv, addr := startTestServer(t, conf)
+	defer srv.Stop()
+
+	dial := func(user string, answer func() string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) != 1 || questions[0] != "Verification code: " || echos[0] {
+					return nil, errors.New("unexpected questions")
+				}
+				return []string{answer()}, nil
+			})},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	if _, err := dial("alice", func() string { return "000000" }); err == nil {
+		t.Fatal("expected a wrong code to be refused")
+	}
+	var code string
+	client, err := dial("alice", func() string {
+		code = totp.Code(secret, time.Now())
+		return code
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Run("")
+	client.Close()
+	if method := <-methods; method != AuthMethodKeyboardInteractive {
+		t.Errorf("expected %s, got %s", AuthMethodKeyboardInteractive, method)
+	}
+	if _, err := dial("alice", func() string { return code }); err == nil {
+		t.Error("expected a replayed code to be refused")
+	}
+
+	// A failing store refuses the user
+	totp.Store = failingTOTPStore{}
+	if _, err := dial("alice", func() string { return totp.Code(secret, time.Now()) }); err == nil {
+		t.Error("expected a failing store to refuse the user")
+	}
+}
@@ -0,0 +1,143 @@
+package shelob
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filer is implemented by the listeners which can hand their socket to another process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade starts a new process which inherits the listening sockets, such as a
+// newly installed binary. Both processes accept connections until the new one
+// has opened its listeners, then this server drains its connections as with
+// the SignalDrain action. No connections are refused during the handoff.
+func (s *Server) Upgrade() error {
+	pid, err := s.upgrade()
+	if err != nil {
+		s.handleEvent(&UpgradeFailedEvent{Error: err})
+		return err
+	}
+	s.handleEvent(&UpgradedEvent{PID: pid})
+	s.drain()
+	return nil
+}
+
+func (s *Server) upgrade() (pid int, err error) {
+	s.connsMu.Lock()
+	if s.draining {
+		s.connsMu.Unlock()
+		return 0, fmt.Errorf("upgrade: server is draining")
+	}
+	s.connsMu.Unlock()
+
+	args := s.config.UpgradeCommand
+	if len(args) == 0 {
+		executable, err := os.Executable()
+		if err != nil {
+			return 0, fmt.Errorf("upgrade: %s", err)
+		}
+		args = append([]string{executable}, os.Args[1:]...)
+	}
+
+	// Duplicate the listening sockets for the new process
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		lf, ok := l.Listener.(filer)
+		if !ok {
+			return 0, fmt.Errorf("upgrade: listener %q: %T cannot be inherited", l.name, l.Listener)
+		}
+
+		// The new process keeps serving the socket path, so closing the
+		// listener while draining must not remove it
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+			defer func() {
+				if err != nil {
+					ul.SetUnlinkOnClose(true)
+				}
+			}()
+		}
+		f, err := lf.File()
+		if err != nil {
+			return 0, fmt.Errorf("upgrade: listener %q: %s", l.name, err)
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+
+	// The new process writes to the pipe once its listeners are open
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: %s", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case envListenPID, envListenFDs, envListenFDNames, envUpgradeReadyFD:
+		default:
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envListenFDs+"="+strconv.Itoa(len(names)),
+		envListenFDNames+"="+strings.Join(names, ":"),
+		envUpgradeReadyFD+"="+strconv.Itoa(listenFDsStart+len(names)),
+	)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("upgrade: %s", err)
+	}
+	pid = cmd.Process.Pid
+	s.handleEvent(&UpgradeStartedEvent{PID: pid})
+
+	// Close the write end so the read fails if the new process exits
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- cmd.Wait()
+	}()
+	readyCh := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		readyCh <- err
+	}()
+
+	timer := time.NewTimer(s.config.UpgradeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-readyCh:
+		if err == nil {
+			return pid, nil
+		}
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("upgrade: process %d exited before it was ready", pid)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("upgrade: process %d was not ready within %s", pid, s.config.UpgradeTimeout)
+	}
+}
@@ -0,0 +1,202 @@
+package shelob
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestListenersFromEnv(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The inherited descriptor is closed, so hand over a copy
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		envListenPID:     strconv.Itoa(os.Getpid()),
+		envListenFDs:     "1",
+		envListenFDNames: "ssh",
+	}
+	listeners, err := listenersFromEnv(func(key string) string { return env[key] }, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].name != "ssh" || listeners[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("unexpected listeners %+v", listeners)
+	}
+	listeners[0].Close()
+
+	// Sockets passed to another process are ignored
+	env[envListenPID] = "1"
+	if listeners, err := listenersFromEnv(func(key string) string { return env[key] }, 0); err != nil || len(listeners) != 0 {
+		t.Fatalf("unexpected listeners %+v %v", listeners, err)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	loadInherited()
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	named, unnamed, other := listen(), listen(), listen()
+	defer named.Close()
+	defer unnamed.Close()
+	defer other.Close()
+	defer func() {
+		inherited.mu.Lock()
+		inherited.listeners = nil
+		inherited.mu.Unlock()
+	}()
+
+	// Sockets are matched by name, then by address
+	inherited.mu.Lock()
+	inherited.listeners = []inheritedListener{{unnamed, "unknown"}, {named, "admin"}}
+	inherited.mu.Unlock()
+	s := &Server{listeners: []*listener{
+		{name: DefaultListenerName, addr: unnamed.Addr().String()},
+		{name: "admin", addr: "127.0.0.1:1"},
+	}}
+	if err := s.inherit(); err != nil {
+		t.Fatal(err)
+	}
+	if s.listeners[0].Listener != unnamed || s.listeners[1].Listener != named {
+		t.Fatalf("unexpected listeners %v %v", s.listeners[0].Listener.Addr(), s.listeners[1].Listener.Addr())
+	}
+
+	// A socket bound elsewhere is not used in place of the address
+	inherited.mu.Lock()
+	inherited.listeners = []inheritedListener{{other, "unknown"}}
+	inherited.mu.Unlock()
+	s = &Server{listeners: []*listener{{name: DefaultListenerName, addr: "127.0.0.1:1"}}}
+	if err := s.inherit(); err == nil || s.listeners[0].Listener != nil {
+		t.Fatal("expected a socket on another address to fail")
+	}
+
+	for addr, want := range map[string]bool{
+		":22":          true,
+		"":             true,
+		"0.0.0.0:22":   true,
+		"[::]:22":      true,
+		"127.0.0.1:22": false,
+		":2222":        false,
+	} {
+		l := &listener{addr: addr}
+		if l.bindsTo(&net.TCPAddr{IP: net.IPv6unspecified, Port: 22}) != want {
+			t.Errorf("%q: expected %v", addr, want)
+		}
+	}
+}
+
+// TestUpgradeChild is the new process started by TestUpgrade.
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv("SHELOB_TEST_UPGRADE_CHILD") == "" {
+		t.Skip("started by TestUpgrade")
+	}
+	srv, _ := startTestServer(t, &Config{
+		ChannelHandlers: writeHandlers("child"),
+		Listeners:       []ListenerConfig{{Name: "unix"}},
+	})
+	defer srv.Stop()
+
+	// Serve until TestUpgrade is done, or it is gone
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case <-time.After(time.Minute):
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a process")
+	}
+	os.Setenv("SHELOB_TEST_UPGRADE_CHILD", "1")
+	defer os.Unsetenv("SHELOB_TEST_UPGRADE_CHILD")
+
+	dir, err := ioutil.TempDir("", "shelob-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ssh.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pids := make(chan int, 1)
+	srv, addr := startTestServer(t, &Config{
+		ChannelHandlers: writeHandlers("parent"),
+		Listeners:       []ListenerConfig{{Name: "unix", Listener: unixListener}},
+		UpgradeCommand:  []string{os.Args[0], "-test.run=^TestUpgradeChild$"},
+		EventHandler: func(evt Event) {
+			if e, ok := evt.(*UpgradeStartedEvent); ok {
+				pids <- e.PID
+			}
+		},
+	})
+	defer srv.Stop()
+
+	before := dialTestServer(t, addr)
+	if err := srv.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	pid := <-pids
+	defer syscall.Kill(pid, syscall.SIGTERM)
+
+	// Open connections are drained by the old process
+	if out := sessionOutput(t, before); out != "parent" {
+		t.Fatalf("expected existing connection to be served by the old process, got %q", out)
+	}
+	before.Close()
+	select {
+	case <-srv.doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected old process to drain")
+	}
+
+	after := dialTestServer(t, addr)
+	defer after.Close()
+	if out := sessionOutput(t, after); out != "child" {
+		t.Fatalf("expected new connection to be served by the new process, got %q", out)
+	}
+
+	// The old process leaves the Unix socket path to the new process
+	unixClient, err := ssh.Dial("unix", socket, &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("expected the Unix socket to be served by the new process, got %v", err)
+	}
+	defer unixClient.Close()
+	if out := sessionOutput(t, unixClient); out != "child" {
+		t.Fatalf("expected new Unix connection to be served by the new process, got %q", out)
+	}
+}